@@ -1,23 +1,29 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bzz/scholar-alert-digest/gmailutils"
 	"github.com/bzz/scholar-alert-digest/gmailutils/token"
 	js "github.com/bzz/scholar-alert-digest/json"
 	"github.com/bzz/scholar-alert-digest/papers"
+	"github.com/bzz/scholar-alert-digest/store"
 	"github.com/bzz/scholar-alert-digest/templates"
 	"github.com/rs/cors"
 
@@ -31,21 +37,31 @@ const user = "me"
 
 var ( // templates
 	chooseLabelsForm = `
-{{ define "title" }}Chose a label{{ end }}
+{{ define "title" }}Chose labels{{ end }}
 {{ define "style" }}{{ end }}
 {{ define "body" }}
-<p>Please, chosse a Gmail label to aggregate:</p>
+<p>Please, chosse Gmail labels to aggregate, each in a separate section:</p>
 <form action="/labels" method="POST">
-{{ range . }}
+{{ range .Labels }}
     <div>
-      <input type="radio" id="{{.}}" name="label" value="{{.}}">
+      <input type="checkbox" id="{{.}}" name="label" value="{{.}}">
       <label for="{{.}}">{{.}}</label>
 	</div>
 {{ end }}
+    <div>
+      <label for="glob">or all labels matching:</label>
+      <input type="text" id="glob" name="label" placeholder="research/*">
+    </div>
 
-  <input type="submit" value="Select Label"/>
+  <input type="submit" value="Select Labels"/>
+</form>
+{{ if .CSRF }}
+<form action="/logout" method="POST">
+  <input type="hidden" name="csrf" value="{{.CSRF}}">
+  <input type="submit" value="Log out"/>
 </form>
 {{ end }}
+{{ end }}
 `
 )
 
@@ -60,17 +76,59 @@ var ( // configuration
 		Endpoint:     google.Endpoint,
 		Scopes:       []string{gmail.GmailReadonlyScope},
 	}
+	revokeURL = "https://oauth2.googleapis.com/revoke"
 )
 
 var ( // CLI
 	compact = flag.Bool("compact", false, "output report in compact format (>100 papers)")
 	test    = flag.Bool("test", false, "read emails from ./fixtures/* instead of real Gmail")
 	dev     = flag.Bool("dev", false, "development mode where /login/auth redirects to :9000 and CORS is enabled")
+	syncDir = flag.String("sync", "", "directory to keep a local record of each user's messages, synced incrementally")
+	cache   = flag.String("cache", "", "directory to cache the fetched messages in")
+	dbDir   = flag.String("db", "", "directory to keep a database of each user's reviewed papers in")
+	sessDir = flag.String("sessions", "", "directory to keep encrypted sessions in, to survive restarts (needs SAD_SESSION_SECRET)")
+	noHTTPS = flag.Bool("insecure-cookies", false, "send cookies over plain HTTP too, e.g. when not on localhost and not behind HTTPS")
 	// TODO(bzz): add -read support + equivalent per-user config option (cookies)
 )
 
 var htmlRn, jsonRn templates.Renderer
 
+// sessions keep the OAuth tokens of all the users, by a session ID in a cookie.
+var sessions *token.Sessions
+
+// newSource returns a source of messages for a user \w the given token.
+// It is overriden in -test mode and by tests, to use fixtures instead of Gmail.
+var newSource = func(ctx context.Context, tok *oauth2.Token) (gmailutils.MessageSource, error) {
+	src, err := gmailutils.NewGmailSource(userClient(ctx, tok), user, concurReq)
+	if err != nil {
+		return nil, err
+	}
+	if *cache != "" { // per user, as message IDs are only unique in a mailbox
+		account, err := src.Account(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := gmailutils.NewCache(filepath.Join(*cache, account), 100<<20, 30*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		src.SetCache(c)
+	}
+	if *syncDir != "" {
+		return gmailutils.NewSyncSource(src, *syncDir), nil
+	}
+	return src, nil
+}
+
+// userClient returns a client \w the token of the user, that saves it back to the session, once refreshed.
+func userClient(ctx context.Context, tok *oauth2.Token) *http.Client {
+	var save func(*oauth2.Token) error
+	if id, ok := token.SessionIDFromContext(ctx); ok {
+		save = func(t *oauth2.Token) error { return sessions.Save(id, t) }
+	}
+	return oauth2.NewClient(ctx, token.NewSavingSource(oauthCfg.TokenSource(ctx, tok), tok, save))
+}
+
 func main() {
 	flag.Parse()
 
@@ -81,6 +139,21 @@ func main() {
 	htmlRn = templates.NewHTMLRenderer(templateText, style)
 	jsonRn = templates.NewJSONRenderer()
 
+	if err := initSessions(); err != nil {
+		log.Fatalf("Unable to create sessions: %v", err)
+	}
+
+	if *dbDir != "" { // marking reviewed emails as read
+		oauthCfg.Scopes = append(oauthCfg.Scopes, gmail.GmailModifyScope)
+	}
+
+	if *test {
+		fixtures := gmailutils.NewFixturesSource("./fixtures")
+		newSource = func(context.Context, *oauth2.Token) (gmailutils.MessageSource, error) {
+			return fixtures, nil
+		}
+	}
+
 	// TODO(bzz):
 	//  - configure the log level, to include requests in debug
 	//  - add default req timeouts + throttling, to prevent abuse
@@ -88,6 +161,11 @@ func main() {
 	log.Printf("starting the web server at http://%s", addr)
 	defer log.Printf("stoping the web server")
 
+	http.ListenAndServe(addr, newRouter())
+}
+
+// newRouter returns a handler of all the routes, as configured by the flags.
+func newRouter() http.Handler {
 	r := chi.NewRouter()
 	r.Use(tokenAndLabelCookiesCtx)
 	// r.Use(middleware.Logger)
@@ -103,6 +181,7 @@ func main() {
 	r.Post("/labels", handleLabelsWrite)
 	r.Get("/login", handleLogin)
 	r.Get("/login/authorized", handleAuth)
+	r.Post("/logout", handleLogout)
 
 	r.Route("/json", func(j chi.Router) {
 		j.Use(setContentType("application/json"))
@@ -115,10 +194,33 @@ func main() {
 
 		j.Get("/labels", listLabels)
 		j.With(labelCtx).Post("/messages", listMessages)
+		if *dbDir != "" {
+			j.Post("/reviewed", markReviewed)
+			j.With(labelCtx).Post("/messages/mark-reviewed", markReviewedMessages)
+		}
 		// j.Get("/papers", listPapers)
 	})
+	return r
+}
+
+// initSessions creates the session store, \w a secret from SAD_SESSION_SECRET env variable.
+// Sessions \wo a secret are lost on restart.
+func initSessions() error {
+	secret := []byte(os.Getenv("SAD_SESSION_SECRET"))
+	if len(secret) == 0 {
+		if *sessDir != "" {
+			return fmt.Errorf("-sessions requires a secret in SAD_SESSION_SECRET")
+		}
+		log.Printf("No SAD_SESSION_SECRET set, all sessions will be lost on restart")
+		secret = token.RandomSecret()
+	}
 
-	http.ListenAndServe(addr, r)
+	var err error
+	if sessions, err = token.NewSessions(secret, *sessDir); err != nil {
+		return err
+	}
+	sessions.Secure = !*noHTTPS
+	return nil
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -130,70 +232,65 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gmailLabel, hasLabel := token.LabelFromContext(r.Context())
+	labels, hasLabel := token.LabelsFromContext(r.Context())
 	if !hasLabel && !*test {
 		log.Printf("Redirecting to /labels as there is no label")
 		http.Redirect(w, r, "/labels", http.StatusFound)
 		return
 	}
 
-	// find and fetch email messages
-	var rMsgs, urMsgs []*gmail.Message
-	if !*test { // TODO(bzz): refactor, replace \w polymorphism though interface for fetching messages
-		var err error
-		srv, _ := gmail.New(oauthCfg.Client(r.Context(), tok)) // ignore err as client != nil
-		query := fmt.Sprintf("label:%s is:unread", gmailLabel)
-		urMsgs, err = gmailutils.FetchConcurent(r.Context(), srv, user, query, concurReq)
-		if err != nil {
-			// TODO(bzz): token expiration looks ugly here and must be handled elsewhere
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	} else {
-		urMsgs = gmailutils.ReadMsgFixturesJSON("./fixtures/unread.json")
-		rMsgs = gmailutils.ReadMsgFixturesJSON("./fixtures/read.json")
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	// aggregate
-	urStats, urTitles := papers.ExtractAndAggPapersFromMsgs(urMsgs, true, true)
-	if urStats.Errs != 0 {
-		log.Printf("%d errors found, extracting the papers", urStats.Errs)
+	// find and fetch email messages, aggregate
+	sections, err := fetchSections(r.Context(), tok, labels)
+	if token.IsReauth(err) {
+		reauth(w, r, err)
+		return
+	} else if err == errNoLabel {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
 	}
-
-	rStats, rTitles := papers.ExtractAndAggPapersFromMsgs(rMsgs, true, true)
-	if rStats.Errs != 0 {
-		log.Printf("%d errors found, extracting the papers", rStats.Errs)
+	for _, s := range sections {
+		s.Unread, s.Read = filter.Apply(s.Unread), filter.Apply(s.Read)
 	}
 
 	// render
 	if _, ok := r.URL.Query()["json"]; ok {
 		w.Header().Set("Content-Type", "application/json")
-		jsonRn.Render(w, urStats, urTitles, rTitles)
+		jsonRn.RenderSections(w, sections)
 	} else {
-		htmlRn.Render(w, urStats, urTitles, nil)
+		for _, s := range sections {
+			s.Read = nil
+		}
+		htmlRn.RenderSections(w, sections)
 	}
 }
 
 func handleLabelsRead(w http.ResponseWriter, r *http.Request) {
-	var gmLabels []*gmail.Label
-	if !*test {
-		tok, authorized := token.FromContext(r.Context())
-		if !authorized { // TODO(bzz): move this to middleware
-			http.Redirect(w, r, "/login", http.StatusFound)
-			return
-		}
+	tok, authorized := token.FromContext(r.Context())
+	if !authorized && !*test { // TODO(bzz): move this to middleware
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
 
-		client := oauthCfg.Client(r.Context(), tok)
-		labelsResp, err := gmailutils.FetchLabels(r.Context(), client)
-		if err != nil {
-			log.Printf("Unable to retrieve all labels: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		gmLabels = labelsResp.Labels
-	} else {
-		gmLabels = gmailutils.ReadLblFixturesJSON("./fixtures/labels.json")
+	gmLabels, err := fetchLabels(r.Context(), tok)
+	if token.IsReauth(err) {
+		reauth(w, r, err)
+		return
+	} else if err != nil {
+		log.Printf("Unable to retrieve all labels: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	var labels []string // user labels, sorted
@@ -208,7 +305,14 @@ func handleLabelsRead(w http.ResponseWriter, r *http.Request) {
 	// render combination of the nested templates
 	tmpl := template.Must(templates.RootLayout.Clone())
 	tmpl = template.Must(tmpl.Parse(chooseLabelsForm))
-	err := tmpl.Execute(w, labels)
+	var csrf string
+	if id, ok := token.SessionIDFromContext(r.Context()); ok {
+		csrf = sessions.CSRFToken(id)
+	}
+	err = tmpl.Execute(w, struct {
+		Labels []string
+		CSRF   string
+	}{labels, csrf})
 	if err != nil {
 		log.Printf("Failed to render a template: %v", err)
 	}
@@ -226,18 +330,29 @@ func saveLabelToCookies(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	humanLabel := r.FormValue("label")
-	label := gmailutils.FormatAsID(humanLabel)
+	var labels []string // names from checkboxes, and comma-separated names or globs
+	for _, humanLabels := range r.Form["label"] {
+		labels = append(labels, gmailutils.SplitLabels(humanLabels)...)
+	}
 
-	cookie := token.NewLabelCookie(label)
+	cookie := token.NewLabelCookie(labels...)
+	cookie.Secure = sessions.Secure
 	log.Printf("Saving new cookie: %s", cookie.String())
 	http.SetCookie(w, cookie)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
+	// bind the login to this browser, to only accept the redirect back for it
+	state, verifier, err := sessions.NewLogin(w)
+	if err != nil {
+		log.Printf("Unable to start a login: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	// the URL which shows the Google Auth page to the user
-	url := oauthCfg.AuthCodeURL("")
-	http.Redirect(w, r, url, http.StatusFound)
+	authURL := oauthCfg.AuthCodeURL(state, token.ChallengeOptions(verifier)...)
+	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 func handleAuth(w http.ResponseWriter, r *http.Request) {
@@ -249,20 +364,34 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if e := r.FormValue("error"); e != "" { // e.g. the user has denied the access
+		log.Printf("Login failed: %s", e)
+		http.Error(w, fmt.Sprintf("Login failed: %s. Please, try to log in again at /login", e), http.StatusForbidden)
+		return
+	}
+
+	verifier, err := sessions.Login(w, r)
+	if err != nil {
+		log.Printf("Unable to complete the login: %v", err)
+		http.Error(w, "Login has expired or was started in another browser. Please, log in again at /login", http.StatusBadRequest)
+		return
+	}
+
 	// exchange the received code for a bearer token
 	code := r.FormValue("code")
-	// FIXME(bzz): validate that r.FormValue("state") is the same as in AuthCodeURL()
-	tok, err := oauthCfg.Exchange(r.Context(), code)
+	tok, err := oauthCfg.Exchange(r.Context(), code, token.VerifierOption(verifier))
 	if err != nil {
 		log.Printf("Unable to exchange the code %q for token: %v", code, err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// save token in the session cookie
-	cookie := token.NewSessionCookie(tok)
-	log.Printf("Saving new cookie: %s", cookie.String())
-	http.SetCookie(w, cookie)
+	// keep the token on the server, only the session ID goes to the cookie
+	if _, err := sessions.New(w, tok); err != nil {
+		log.Printf("Unable to start a session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	toURL := "/"
 	if *dev {
@@ -271,11 +400,74 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, toURL, http.StatusMovedPermanently)
 }
 
-// tokenAndLabelCookiesCtx reads token from request cookie and saves it to the Context.
+// handleLogout revokes the token of the session at the OAuth provider,
+// ends the session and clears all the cookies. Requests of a session must
+// have its CSRF token, so that other sites can not log the user out.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if id, ok := token.SessionIDFromContext(r.Context()); ok {
+		if err := sessions.CheckCSRF(r, id); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if tok, ok := token.FromContext(r.Context()); ok {
+		if err := revokeToken(r.Context(), tok); err != nil { // the session ends anyway
+			log.Printf("Unable to revoke the token: %v", err)
+		}
+	}
+	sessions.Delete(w, r)
+
+	cookie := token.NewLabelCookie()
+	cookie.Secure, cookie.MaxAge = sessions.Secure, -1
+	http.SetCookie(w, cookie)
+
+	if *dev {
+		http.Redirect(w, r, "//localhost:9000", http.StatusFound)
+		return
+	}
+	w.Write([]byte("Logged out\n"))
+}
+
+// revokeToken revokes the access to Gmail, granted to the token.
+func revokeToken(ctx context.Context, tok *oauth2.Token) error {
+	t := tok.RefreshToken // revokes the access token as well
+	if t == "" {
+		t = tok.AccessToken
+	}
+	req, err := http.NewRequest("POST", revokeURL, strings.NewReader(url.Values{"token": {t}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// reauth ends the session, as its token has expired and can not be refreshed,
+// and redirects the user to log in again.
+func reauth(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Redirecting to /login as the token has expired: %v", err)
+	sessions.Delete(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Refresh", "3; url=/login")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`<p>Access to Gmail has expired or was revoked. Redirecting you to <a href="/login">log in</a> again...</p>`))
+}
+
+// tokenAndLabelCookiesCtx resolves token of the session from request cookie and saves it to the Context.
 func tokenAndLabelCookiesCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.Method, "-", r.RequestURI /*, r.Cookies()*/) // TODO(bzz): make cookies debug level only
-		ctx := token.NewSessionContext(r.Context(), r.Cookies())
+		ctx := sessions.NewContext(r)
 		ctx = token.NewLabelContext(ctx, r.Cookies())
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -295,35 +487,21 @@ func setContentType(contentType string) func(next http.Handler) http.Handler {
 
 type contextKey string
 
-func (k contextKey) readFrom(cookies []*http.Cookie) *http.Cookie {
-	var cookie *http.Cookie
-	for _, c := range cookies {
-		if c.Name == string(k) {
-			cookie = c
-			break
-		}
-	}
-	return cookie
-}
-
 const (
 	tokenKey contextKey = "token"
 	labelKey contextKey = "label"
 )
 
 func listLabels(w http.ResponseWriter, r *http.Request) {
-	var gmLabels []*gmail.Label
-	if !*test {
-		tok := r.Context().Value(tokenKey).(*oauth2.Token)
-		client := oauthCfg.Client(r.Context(), tok)
-		labelsResp, err := gmailutils.FetchLabels(r.Context(), client)
-		if err != nil {
-			js.ErrNotFound(w, err, "Unable to retrieve labels from Gmail")
-			return
-		}
-		gmLabels = labelsResp.Labels
-	} else {
-		gmLabels = gmailutils.ReadLblFixturesJSON("./fixtures/labels.json")
+	tok, _ := r.Context().Value(tokenKey).(*oauth2.Token)
+	gmLabels, err := fetchLabels(r.Context(), tok)
+	if token.IsReauth(err) {
+		sessions.Delete(w, r)
+		js.ErrReauth(w, err, "/login")
+		return
+	} else if err != nil {
+		js.ErrNotFound(w, err, "Unable to retrieve labels from Gmail")
+		return
 	}
 
 	var labels []string // user labels, sorted
@@ -331,7 +509,7 @@ func listLabels(w http.ResponseWriter, r *http.Request) {
 		if l.Type == "system" {
 			continue
 		}
-		labels = append(labels, gmailutils.FormatAsID(l.Name))
+		labels = append(labels, l.Name)
 	}
 	sort.Strings(labels)
 
@@ -341,62 +519,277 @@ func listLabels(w http.ResponseWriter, r *http.Request) {
 }
 
 func listMessages(w http.ResponseWriter, r *http.Request) {
-	label := r.Context().Value(labelKey).(string)
+	label, _ := r.Context().Value(labelKey).(string)
+	tok, _ := r.Context().Value(tokenKey).(*oauth2.Token)
 
-	var err error
-	var urMsgs, rMsgs []*gmail.Message
-	if !*test { // TODO(bzz): refactor, replace \w polymorphism though interface for fetching messages
-		tok := r.Context().Value(tokenKey).(*oauth2.Token)
-		srv, _ := gmail.New(oauthCfg.Client(r.Context(), tok)) // ignore err as client != nil
-		query := fmt.Sprintf("label:%s is:unread", label)
-		urMsgs, err = gmailutils.FetchConcurent(r.Context(), srv, user, query, concurReq)
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		js.ErrUnprocessable(w, err, "invalid paper filter")
+		return
+	}
+
+	sections, err := fetchSections(r.Context(), tok, gmailutils.SplitLabels(label))
+	if err != nil {
+		errFailedDependency(w, r, err, "failed to fetch messages from Gmail")
+		return
+	}
+	for _, s := range sections {
+		s.Unread, s.Read = filter.Apply(s.Unread), filter.Apply(s.Read)
+	}
+
+	jsonRn.RenderSections(w, sections)
+}
+
+// markReviewed records papers as reviewed, or not, by the user.
+// Request is {"papers": [<URL, ID or title>, ...], "reviewed": true}.
+func markReviewed(w http.ResponseWriter, r *http.Request) {
+	tok, _ := r.Context().Value(tokenKey).(*oauth2.Token)
+	req := struct {
+		Papers   []string `json:"papers"`
+		Reviewed bool     `json:"reviewed"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		js.ErrUnprocessable(w, err, "Unable to decode JSON request")
+		return
+	}
+
+	db, err := userStore(r.Context(), tok)
+	if err != nil {
+		errFailedDependency(w, r, err, "failed to open the database of reviewed papers")
+		return
+	}
+	if err := db.MarkReviewed(req.Papers, req.Reviewed, time.Now()); err != nil {
+		js.ErrInternal(w, err, "failed to save reviewed papers")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"papers": len(req.Papers), "reviewed": req.Reviewed})
+}
+
+// markReviewedMessages marks as read only the unread messages under the label,
+// all the papers of which were reviewed. Partially reviewed messages stay unread.
+func markReviewedMessages(w http.ResponseWriter, r *http.Request) {
+	label, _ := r.Context().Value(labelKey).(string)
+	tok, _ := r.Context().Value(tokenKey).(*oauth2.Token)
+	ctx := r.Context()
+
+	db, err := userStore(ctx, tok)
+	if err != nil {
+		errFailedDependency(w, r, err, "failed to open the database of reviewed papers")
+		return
+	}
+	src, err := newSource(ctx, tok)
+	if err != nil {
+		errFailedDependency(w, r, err, "failed to connect to Gmail")
+		return
+	}
+
+	var ids []string
+	labels, err := gmailutils.ExpandLabels(ctx, src, gmailutils.SplitLabels(label))
+	if err == nil {
+		ids, err = reviewedMessages(ctx, src, db, labels)
+	}
+	if err != nil {
+		errFailedDependency(w, r, err, "failed to fetch messages from Gmail")
+		return
+	}
+
+	msgs := make([]*gmail.Message, len(ids))
+	for i, id := range ids {
+		msgs[i] = &gmail.Message{Id: id}
+	}
+	if err := gmailutils.ModifyMsgs(ctx, src, msgs, nil, []string{"UNREAD"}); err != nil {
+		errFailedDependency(w, r, err, "failed to mark messages as read in Gmail")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"marked": ids})
+}
+
+// reviewedMessages returns IDs of the unread messages under the labels, all the papers of which were reviewed.
+func reviewedMessages(ctx context.Context, src gmailutils.MessageSource, db *store.Store, labels []string) ([]string, error) {
+	labels, err := orTestLabel(labels)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, label := range labels {
+		unread, err := gmailutils.FetchConcurent(ctx, src, gmailutils.Query{}.Label(label).Unread().String())
 		if err != nil {
-			js.ErrFailedDependency(w, err, "failed to fetch messages from Gmail")
-			return
+			return nil, err
+		}
+		_, agg := papers.ExtractAndAggPapersFromMsgs(unread, false, true)
+		reviewed, err := db.ReviewedMessages(agg)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, reviewed...)
+	}
+	return ids, nil
+}
+
+// stores are the databases of reviewed papers, by user account.
+var stores = struct {
+	sync.Mutex
+	m map[string]*store.Store
+}{m: map[string]*store.Store{}}
+
+// userStore returns the database of the user \w a given token, opening it on the first use.
+func userStore(ctx context.Context, tok *oauth2.Token) (*store.Store, error) {
+	src, err := newSource(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	account := "test"
+	if a, ok := src.(interface {
+		Account(context.Context) (string, error)
+	}); ok {
+		if account, err = a.Account(ctx); err != nil {
+			return nil, err
 		}
-	} else {
-		urMsgs = gmailutils.ReadMsgFixturesJSON("./fixtures/unread.json")
-		rMsgs = gmailutils.ReadMsgFixturesJSON("./fixtures/read.json")
 	}
 
-	// aggregate
-	urStats, urTitles := papers.ExtractAndAggPapersFromMsgs(urMsgs, true, true)
-	if urStats.Errs != 0 {
-		log.Printf("%d errors found, extracting the papers", urStats.Errs)
+	stores.Lock()
+	defer stores.Unlock()
+	if db, ok := stores.m[account]; ok {
+		return db, nil
+	}
+	if err := os.MkdirAll(*dbDir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := store.Open(filepath.Join(*dbDir, account+".db"))
+	if err != nil {
+		return nil, err
 	}
+	stores.m[account] = db
+	return db, nil
+}
 
-	rStats, rTitles := papers.ExtractAndAggPapersFromMsgs(rMsgs, true, true)
-	if rStats.Errs != 0 {
-		log.Printf("%d errors found, extracting the papers", urStats.Errs)
+// filterFromQuery returns a filter of papers from URL query parameters
+// e.g. ?author=Hu&venue=ICSE&host=arxiv.org&min-year=2019&kind=citations
+func filterFromQuery(r *http.Request) (papers.Filter, error) {
+	q := r.URL.Query()
+	f := papers.Filter{Author: q.Get("author"), Venue: q.Get("venue"), Host: q.Get("host")}
+	var err error
+	if y := q.Get("min-year"); y != "" {
+		if f.MinYear, err = strconv.Atoi(y); err != nil {
+			return f, fmt.Errorf("min-year %q is not a number", y)
+		}
 	}
+	if k := q.Get("kind"); k != "" {
+		if f.Kind, err = gmailutils.ParseAlertKind(k); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
 
-	jsonRn.Render(w, urStats, urTitles, rTitles)
+// fetchLabels returns all the labels of the user \w a given token.
+func fetchLabels(ctx context.Context, tok *oauth2.Token) ([]*gmail.Label, error) {
+	src, err := newSource(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	return src.Labels(ctx)
 }
 
-func tokenCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+// fetchSections returns the papers from the messages under the given labels
+// (or globs of them), in a section per label. Messages and papers under several
+// labels are only included in the first section.
+func fetchSections(ctx context.Context, tok *oauth2.Token, labels []string) ([]*papers.Section, error) {
+	src, err := newSource(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	if labels, err = gmailutils.ExpandLabels(ctx, src, labels); err != nil {
+		return nil, err
+	}
+	if labels, err = orTestLabel(labels); err != nil {
+		return nil, err
+	}
 
-		tokenCookie := tokenKey.readFrom(r.Cookies())
-		if tokenCookie == nil {
-			js.ErrUnauthorized(w, oauthCfg.AuthCodeURL("scholar"))
-			return
+	var sections []*papers.Section
+	urSeen, rSeen := map[string]bool{}, map[string]bool{}
+	for _, label := range labels {
+		urMsgs, rMsgs, err := fetchMessages(ctx, src, label)
+		if err != nil {
+			return nil, err
 		}
 
-		data, err := base64.StdEncoding.DecodeString(tokenCookie.Value)
-		if err != nil {
-			js.ErrUnprocessable(w, err, "Unable to decode base64 cookie: "+string(tokenKey))
-			return
+		urStats, urTitles := papers.ExtractAndAggPapersFromMsgs(gmailutils.Unseen(urMsgs, urSeen), true, true)
+		if urStats.Errs != 0 {
+			log.Printf("%d errors found, extracting the papers", urStats.Errs)
 		}
 
-		tok := &oauth2.Token{}
-		err = json.NewDecoder(bytes.NewReader(data)).Decode(tok)
+		rStats, rTitles := papers.ExtractAndAggPapersFromMsgs(gmailutils.Unseen(rMsgs, rSeen), true, true)
+		if rStats.Errs != 0 {
+			log.Printf("%d errors found, extracting the papers", rStats.Errs)
+		}
+
+		section := &papers.Section{Stats: urStats, Unread: urTitles, Read: rTitles}
+		if len(labels) > 1 {
+			section.Label = label
+		}
+		sections = append(sections, section)
+	}
+	papers.DedupSections(sections)
+	return sections, nil
+}
+
+// errNoLabel is returned for requests \wo a label, unless in -test mode.
+var errNoLabel = errors.New("no label is chosen")
+
+// orTestLabel returns the labels, or an empty one that matches all the fixtures in -test mode.
+func orTestLabel(labels []string) ([]string, error) {
+	if len(labels) != 0 {
+		return labels, nil
+	}
+	if !*test {
+		return nil, errNoLabel
+	}
+	return []string{""}, nil
+}
+
+// fetchMessages returns unread and read messages under a given label.
+func fetchMessages(ctx context.Context, src gmailutils.MessageSource, label string) (unread, read []*gmail.Message, err error) {
+	query := gmailutils.Query{}.Label(label)
+	unread, err = gmailutils.FetchConcurent(ctx, src, query.Unread().String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *test { // TODO(bzz): add -read support, same as in CLI
+		read, err = gmailutils.FetchConcurent(ctx, src, query.Read().String())
 		if err != nil {
-			js.ErrUnprocessable(w, err, "Unable to decode JSON token: "+string(data))
+			return nil, nil, err
+		}
+	}
+	return unread, read, nil
+}
+
+// errFailedDependency responds \w an error of Gmail, or asks the user to log in again
+// if the token of the session has expired and can not be refreshed.
+// Requests \wo a label are rejected as bad ones.
+func errFailedDependency(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	if token.IsReauth(err) {
+		sessions.Delete(w, r)
+		js.ErrReauth(w, err, "/login")
+		return
+	}
+	if err == errNoLabel {
+		js.ErrBadRequest(w, err, "a label is required")
+		return
+	}
+	js.ErrFailedDependency(w, err, msg)
+}
+
+func tokenCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, ok := token.FromContext(r.Context()) // of the session, see tokenAndLabelCookiesCtx
+		if !ok {
+			js.ErrUnauthorized(w, "/login")
 			return
 		}
 
-		ctx = context.WithValue(ctx, tokenKey, tok)
+		ctx := context.WithValue(r.Context(), tokenKey, tok)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,342 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bzz/scholar-alert-digest/gmailutils"
+	"github.com/bzz/scholar-alert-digest/gmailutils/token"
+	js "github.com/bzz/scholar-alert-digest/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// fakeProvider is a local OAuth provider, that checks the PKCE code challenge
+// of each authorization on the token exchange, and records revoked tokens.
+type fakeProvider struct {
+	*httptest.Server
+	mu         sync.Mutex
+	codes      int
+	challenges map[string]string // by code
+	revoked    []string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.NotEmpty(t, q.Get("code_challenge"))
+
+		p.mu.Lock()
+		code := fmt.Sprintf("code-%d", p.codes)
+		p.codes++
+		p.challenges[code] = q.Get("code_challenge")
+		p.mu.Unlock()
+
+		to := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, to, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if refresh := r.PostForm.Get("refresh_token"); refresh != "" {
+			for _, revoked := range p.revoked {
+				if revoked == refresh {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error": "invalid_grant"}`))
+					return
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "refreshed-" + refresh, "token_type": "Bearer", "expires_in": 3600,
+			})
+			return
+		}
+
+		code := r.PostForm.Get("code")
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		challenge, ok := p.challenges[code]
+		delete(p.challenges, code)
+		if !ok || challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-" + code, "refresh_token": "refresh-" + code,
+			"token_type": "Bearer", "expires_in": 3600,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		p.revoked = append(p.revoked, r.PostForm.Get("token"))
+		p.mu.Unlock()
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// browser keeps the cookies between the requests to a handler.
+type browser struct {
+	h       http.Handler
+	cookies map[string]*http.Cookie
+	header  http.Header // of all the requests, if any
+}
+
+func (b *browser) do(method, target string) *http.Response {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range b.header {
+		r.Header[k] = v
+	}
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.h.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return w.Result()
+}
+
+// authorize follows the redirect from /login to the provider, and returns the redirect back.
+func (b *browser) authorize(t *testing.T) string {
+	resp := b.do("GET", "/login")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return back.RequestURI()
+}
+
+func setupLogin(t *testing.T) (*fakeProvider, func() *browser) {
+	p := newFakeProvider(t)
+	oauthCfg.Endpoint = oauth2.Endpoint{AuthURL: p.URL + "/auth", TokenURL: p.URL + "/token"}
+	revokeURL = p.URL + "/revoke"
+
+	var err error
+	sessions, err = token.NewSessions(token.RandomSecret(), "")
+	require.NoError(t, err)
+
+	h := newRouter()
+	return p, func() *browser { return &browser{h: h, cookies: map[string]*http.Cookie{}} }
+}
+
+func TestLogin(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	b := newBrowser()
+	callback := b.authorize(t)
+	assert.Contains(t, b.cookies, token.LoginCookie)
+
+	resp := b.do("GET", callback)
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.NotContains(t, b.cookies, token.LoginCookie)
+	require.Contains(t, b.cookies, token.SessionCookie)
+	assert.NotContains(t, b.cookies[token.SessionCookie].Value, "access-")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(b.cookies[token.SessionCookie])
+	_, tok, err := sessions.Get(r)
+	require.NoError(t, err)
+	assert.Equal(t, "access-code-0", tok.AccessToken)
+
+	// the redirect can not be replayed
+	resp = b.do("GET", callback)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLoginInvalidState(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	b := newBrowser()
+	callback := b.authorize(t)
+	resp := b.do("GET", strings.Replace(callback, "state=", "state=forged", 1))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotContains(t, b.cookies, token.SessionCookie)
+
+	// a login, started by another browser
+	victim, attacker := newBrowser(), newBrowser()
+	victim.do("GET", "/login")
+	resp = victim.do("GET", attacker.authorize(t))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotContains(t, victim.cookies, token.SessionCookie)
+
+	resp = newBrowser().do("GET", "/login/authorized?error=access_denied")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestLogout(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	b, r := login(t, newBrowser)
+	session := b.cookies[token.SessionCookie]
+	id, _, err := sessions.Get(r)
+	require.NoError(t, err)
+
+	resp := b.do("GET", "/logout")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp = b.do("POST", "/logout") // e.g. a form on another site
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	b.header = http.Header{token.CSRFHeader: {"forged"}}
+	resp = b.do("POST", "/logout")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, p.revoked)
+	require.Contains(t, b.cookies, token.SessionCookie)
+
+	b.header.Set(token.CSRFHeader, sessions.CSRFToken(id))
+	resp = b.do("POST", "/logout")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"refresh-code-0"}, p.revoked)
+	assert.NotContains(t, b.cookies, token.SessionCookie)
+
+	// the session has ended, even for a copy of the cookie
+	b.cookies[token.SessionCookie] = session
+	resp = b.do("GET", "/json/labels")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// login returns a request \w the session of a new login, and the context of it.
+func login(t *testing.T, newBrowser func() *browser) (*browser, *http.Request) {
+	b := newBrowser()
+	b.do("GET", b.authorize(t))
+	require.Contains(t, b.cookies, token.SessionCookie)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(b.cookies[token.SessionCookie])
+	return b, r.WithContext(sessions.NewContext(r))
+}
+
+func TestRefresh(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	_, r := login(t, newBrowser)
+	tok, ok := token.FromContext(r.Context())
+	require.True(t, ok)
+	tok.Expiry = time.Now().Add(-time.Minute)
+
+	resp, err := userClient(r.Context(), tok).Get(p.URL + "/api")
+	require.NoError(t, err)
+	auth, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "Bearer refreshed-refresh-code-0", string(auth))
+
+	_, saved, err := sessions.Get(r)
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed-refresh-code-0", saved.AccessToken, "refreshed token is saved to the session")
+	assert.Equal(t, "refresh-code-0", saved.RefreshToken)
+
+	// once revoked, the token can not be refreshed any more
+	p.mu.Lock()
+	p.revoked = append(p.revoked, saved.RefreshToken)
+	p.mu.Unlock()
+	saved.Expiry = time.Now().Add(-time.Minute)
+	_, err = userClient(r.Context(), saved).Get(p.URL + "/api")
+	assert.True(t, token.IsReauth(err), "%v", err)
+}
+
+// expiredSource fails as a source of a token that can not be refreshed.
+type expiredSource struct {
+	gmailutils.MessageSource
+}
+
+func (expiredSource) Labels(context.Context) ([]*gmail.Label, error) {
+	return nil, &token.ReauthError{Err: errors.New("oauth2: token expired and refresh token is not set")}
+}
+
+func TestReauth(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	defer func(orig func(context.Context, *oauth2.Token) (gmailutils.MessageSource, error)) { newSource = orig }(newSource)
+	newSource = func(context.Context, *oauth2.Token) (gmailutils.MessageSource, error) {
+		return expiredSource{}, nil
+	}
+
+	b, _ := login(t, newBrowser)
+	resp := b.do("GET", "/labels")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "3; url=/login", resp.Header.Get("Refresh"))
+	assert.NotContains(t, b.cookies, token.SessionCookie, "the session has ended")
+
+	b, _ = login(t, newBrowser)
+	resp = b.do("GET", "/json/labels")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	errResp := struct{ Error js.ErrResponse }{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, "/login", errResp.Error.Redirect)
+	assert.NotContains(t, b.cookies, token.SessionCookie)
+}
+
+func TestNoLabel(t *testing.T) {
+	p, newBrowser := setupLogin(t)
+	defer p.Close()
+
+	defer func(orig func(context.Context, *oauth2.Token) (gmailutils.MessageSource, error)) { newSource = orig }(newSource)
+	newSource = func(context.Context, *oauth2.Token) (gmailutils.MessageSource, error) {
+		msgs := []*gmail.Message{{Id: "m1", LabelIds: []string{"INBOX", "UNREAD"}}}
+		return gmailutils.NewMemorySource(nil, msgs), nil
+	}
+
+	b, _ := login(t, newBrowser)
+	r := httptest.NewRequest("POST", "/json/messages", strings.NewReader(`{"label": ""}`))
+	r.AddCookie(b.cookies[token.SessionCookie])
+	w := httptest.NewRecorder()
+	b.h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "all the messages must not be aggregated outside -test")
+}
@@ -0,0 +1,177 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// MaxBatchSize is the max number of requests in a single batch, allowed by Gmail API.
+const MaxBatchSize = 100
+
+// MaxModifyIDs is the max number of messages modified by a single BatchModify request, allowed by Gmail API.
+const MaxModifyIDs = 1000
+
+// DefaultBatchSize is a number of messages fetched by a single batch request.
+// Gmail API docs do not recommend more than 50, as larger batches trigger rate limiting.
+var DefaultBatchSize = 50
+
+// batchGet fetches a few messages by a single multipart/mixed batch request, as documented at
+// https://developers.google.com/gmail/api/guides/batch
+//
+// Messages that failed inside of a batch, or all of them if a whole batch failed,
+// are fetched again one by one.
+func (g *GmailSource) batchGet(ctx context.Context, ids []string) ([]*gmail.Message, []error) {
+	msgs, errs := make([]*gmail.Message, len(ids)), make([]error, len(ids))
+
+	var resp *http.Response
+	err := g.backoff.Do(ctx, func() error {
+		var err error
+		resp, err = g.doBatch(ctx, ids)
+		return err
+	})
+	if err == nil {
+		err = parseBatch(resp, msgs, errs)
+		resp.Body.Close()
+	}
+	if err != nil { // keep the messages, read before the batch failed
+		for i := range errs {
+			if msgs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	for i, id := range ids {
+		if msgs[i] != nil {
+			continue
+		}
+		msgs[i], errs[i] = g.get(ctx, id)
+	}
+	return msgs, errs
+}
+
+// doBatch sends a batch of message gets to Gmail API.
+func (g *GmailSource) doBatch(ctx context.Context, ids []string) (*http.Response, error) {
+	base, err := url.Parse(g.srv.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/batch/gmail/v1"}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, id := range ids {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<item-%d>", i)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(pw, "GET %s%s/messages/%s?format=full\r\n\r\n",
+			base.Path, url.PathEscape(g.user), url.PathEscape(id))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", endpoint.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseBatch reads a multipart/mixed response of a batch, filling in a message or
+// an error for each of the parts. Parts are matched to requests by Content-ID.
+func parseBatch(resp *http.Response, msgs []*gmail.Message, errs []error) error {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("batch: unexpected response content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("batch: failed to read response: %v", err)
+		}
+
+		i, ok := batchItem(part.Header.Get("Content-Id"), len(msgs))
+		if !ok {
+			continue
+		}
+
+		itemResp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			errs[i] = fmt.Errorf("batch: failed to read response of item %d: %v", i, err)
+			continue
+		}
+		if err := googleapi.CheckResponse(itemResp); err != nil {
+			errs[i] = err
+			itemResp.Body.Close()
+			continue
+		}
+
+		msg := &gmail.Message{}
+		if err := json.NewDecoder(itemResp.Body).Decode(msg); err != nil {
+			errs[i] = fmt.Errorf("batch: failed to decode message %d: %v", i, err)
+		} else {
+			msgs[i], errs[i] = msg, nil
+		}
+		itemResp.Body.Close()
+	}
+}
+
+// batchItem returns an index of request by a response Content-ID e.g. "<response-item-1>".
+func batchItem(contentID string, n int) (int, bool) {
+	id := strings.Trim(contentID, "<>")
+	id = strings.TrimPrefix(id, "response-")
+	i, err := strconv.Atoi(strings.TrimPrefix(id, "item-"))
+	if err != nil || i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
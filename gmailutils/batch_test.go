@@ -0,0 +1,78 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchFetch(t *testing.T) {
+	f := &fakeGmail{failures: map[string][]int{
+		"m3": {503},
+		"m7": {404, 404},
+	}}
+	src := newFakeGmailSource(t, f)
+	src.batchSize = 4
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("m%d", i))
+	}
+	msgs, err := src.Fetch(context.Background(), ids)
+
+	require.Error(t, err)
+	assert.Equal(t, []string{"m7"}, err.(*FetchError).IDs())
+	assert.Equal(t, 3, f.batches)
+
+	expected := append(append([]string{}, ids[:7]...), ids[8:]...)
+	assert.Equal(t, expected, MessageIDs(msgs))
+	for _, m := range msgs {
+		assert.Equal(t, "message "+m.Id, m.Snippet)
+	}
+
+	assert.Equal(t, 1, f.calls["m0"], "successful messages must be fetched once")
+	assert.Equal(t, 2, f.calls["m3"], "failed messages must be fetched again, one by one")
+}
+
+func TestBatchFetchTruncated(t *testing.T) {
+	f := &fakeGmail{truncate: true}
+	src := newFakeGmailSource(t, f)
+	src.batchSize = 4
+
+	ids := []string{"m0", "m1", "m2", "m3"}
+	msgs, err := src.Fetch(context.Background(), ids)
+	require.NoError(t, err, "messages, read before the batch failed, must not be reported as failed")
+	assert.Equal(t, ids, MessageIDs(msgs))
+	assert.Equal(t, 1, f.calls["m0"], "must not be fetched again")
+	assert.Equal(t, 1, f.calls["m1"])
+}
+
+func TestBatchFetchFallback(t *testing.T) {
+	f := &fakeGmail{noBatch: true}
+	src := newFakeGmailSource(t, f)
+	src.batchSize = MaxBatchSize + 1
+
+	msgs, err := src.Fetch(context.Background(), []string{"m1", "m2", "m3"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1", "m2", "m3"}, MessageIDs(msgs))
+	assert.Equal(t, 1, f.batches)
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Cache keeps the fetched messages on disk, a JSON file per message ID,
+// in the same shape as the fixtures.
+//
+// Message bodies never change, but the label IDs of a cached message
+// may be out of date e.g. after it was marked as read.
+type Cache struct {
+	dir     string
+	maxSize int64         // in bytes, 0 means no limit
+	maxAge  time.Duration // 0 means no limit
+
+	mu sync.Mutex // serializes eviction
+}
+
+// NewCache returns a cache in a given directory, evicting the oldest messages
+// beyond maxSize bytes in total and all the messages older than maxAge.
+func NewCache(dir string, maxSize int64, maxAge time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %v", dir, err)
+	}
+	return &Cache{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+func (c *Cache) path(id string) string {
+	return filepath.Join(c.dir, url.PathEscape(id)+".json")
+}
+
+// Get returns a cached message, if there is one that has not expired yet.
+func (c *Cache) Get(id string) (*gmail.Message, bool) {
+	path := c.path(id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if c.maxAge > 0 && time.Since(fi.ModTime()) > c.maxAge {
+		os.Remove(path)
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	msg := &gmail.Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		log.Printf("Skipping broken cache of message %q: %v", id, err)
+		os.Remove(path)
+		return nil, false
+	}
+	return msg, true
+}
+
+// Put saves a message to the cache.
+func (c *Cache) Put(msg *gmail.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	path := c.path(msg.Id)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Evict removes all the expired messages, and then the oldest ones, until the cache fits maxSize.
+func (c *Cache) Evict() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		files []os.FileInfo
+		total int64
+	)
+	for _, fi := range entries {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		if c.maxAge > 0 && time.Since(fi.ModTime()) > c.maxAge {
+			os.Remove(filepath.Join(c.dir, fi.Name()))
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// cached returns a batchFunc that only fetches the messages missing in the cache,
+// and saves them there.
+func (c *Cache) cached(fetch batchFunc) batchFunc {
+	return func(ctx context.Context, ids []string) ([]*gmail.Message, []error) {
+		msgs, errs := make([]*gmail.Message, len(ids)), make([]error, len(ids))
+		var missing []string
+		var idx []int
+		for i, id := range ids {
+			if m, ok := c.Get(id); ok {
+				msgs[i] = m
+				continue
+			}
+			missing = append(missing, id)
+			idx = append(idx, i)
+		}
+		if len(missing) == 0 {
+			return msgs, errs
+		}
+
+		fetched, fetchErrs := fetch(ctx, missing)
+		for j, i := range idx {
+			msgs[i], errs[i] = fetched[j], fetchErrs[j]
+			if fetchErrs[j] != nil || fetched[j] == nil {
+				continue
+			}
+			if err := c.Put(fetched[j]); err != nil {
+				log.Printf("Unable to cache message %q: %v", fetched[j].Id, err)
+			}
+		}
+		return msgs, errs
+	}
+}
@@ -0,0 +1,93 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCache(t *testing.T) {
+	c, err := NewCache(tempDir(t), 0, time.Hour)
+	require.NoError(t, err)
+
+	msg := ReadMsgFixturesJSON("../fixtures/unread.json")[0]
+	require.NoError(t, c.Put(msg))
+
+	cached, ok := c.Get(msg.Id)
+	require.True(t, ok)
+	assert.Equal(t, msg.Payload.Headers, cached.Payload.Headers)
+	body, err := MessageTextBody(cached.Payload)
+	require.NoError(t, err)
+	assert.NotEmpty(t, body)
+
+	_, ok = c.Get("missing")
+	assert.False(t, ok)
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(c.path(msg.Id), old, old))
+	_, ok = c.Get(msg.Id)
+	assert.False(t, ok, "expired messages must not be returned")
+}
+
+func TestCacheEvict(t *testing.T) {
+	c, err := NewCache(tempDir(t), 0, 0)
+	require.NoError(t, err)
+
+	for i, id := range []string{"m1", "m2", "m3"} {
+		require.NoError(t, c.Put(&gmail.Message{Id: id, Snippet: "0123456789"}))
+		at := time.Now().Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(c.path(id), at, at))
+	}
+	fi, err := os.Stat(c.path("m1"))
+	require.NoError(t, err)
+
+	c.maxSize = 2 * fi.Size()
+	require.NoError(t, c.Evict())
+	_, ok := c.Get("m1")
+	assert.False(t, ok, "the oldest message must be evicted first")
+	_, ok = c.Get("m3")
+	assert.True(t, ok)
+
+	c.maxAge = 90 * time.Minute
+	require.NoError(t, c.Evict())
+	_, ok = c.Get("m2")
+	assert.False(t, ok, "expired messages must be evicted")
+}
+
+func TestFetchCached(t *testing.T) {
+	f := &fakeGmail{}
+	src := newFakeGmailSource(t, f)
+	c, err := NewCache(tempDir(t), 0, 0)
+	require.NoError(t, err)
+	src.SetCache(c)
+
+	ids := []string{"m1", "m2"}
+	_, err = src.Fetch(context.Background(), ids)
+	require.NoError(t, err)
+
+	msgs, err := src.Fetch(context.Background(), append(ids, "m3"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1", "m2", "m3"}, MessageIDs(msgs))
+	assert.Equal(t, map[string]int{"m1": 1, "m2": 1, "m3": 1}, f.calls)
+}
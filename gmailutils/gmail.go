@@ -28,11 +28,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
-	"sync"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
 	"github.com/bzz/scholar-alert-digest/gmailutils/token"
 
@@ -47,42 +45,106 @@ const Instructions = `Please make sure that you have:
  - a project with Gmail API enabled
    https://developers.google.com/workspace/guides/create-project
  - download "OAuth client ID" credentials for desktop app, saved as 'credentials.json'
+   in the config directory, see -config
    https://developers.google.com/workspace/guides/create-credentials#desktop-app
 `
 
-// NewClient a client configured with OAuth using 'credentials.json' and a 'token.json'.
-func NewClient(needWriteAccess bool) *http.Client {
-	b, err := ioutil.ReadFile("credentials.json")
+// ClientConfig configures where NewClient reads the OAuth credentials from and keeps the tokens in.
+type ClientConfig struct {
+	Dir        string // of 'credentials.json' and the tokens, ConfigDir() by default
+	Account    string // to keep a separate token for e.g. an email address, if any
+	Passphrase string // to encrypt the tokens by, if any, see token.FileStore
+	Write      bool   // needs access to modify the messages
+}
+
+// ConfigDir returns the default directory of 'credentials.json' and the tokens:
+// SAD_CONFIG_DIR env variable, or the current directory if it has 'credentials.json' as before,
+// or the user config directory e.g. ~/.config/scholar-alert-digest on Linux.
+func ConfigDir() string {
+	if dir := os.Getenv("SAD_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	if _, err := os.Stat("credentials.json"); err == nil {
+		return "."
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "scholar-alert-digest")
+}
+
+// TokenFile returns the name of the file of a token for an account, if any,
+// and the access to modify the messages.
+func TokenFile(account string, write bool) string {
+	name := "token"
+	if write {
+		name = "token_rw"
+	}
+	if account != "" {
+		name += "_" + strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(account)
+	}
+	return name + ".json"
+}
+
+// NewClient a client configured with OAuth using 'credentials.json' and a token e.g. 'token.json'.
+func NewClient(c ClientConfig) *http.Client {
+	if c.Dir == "" {
+		c.Dir = ConfigDir()
+	}
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, "credentials.json"))
 	if err != nil {
 		log.Fatalf("Unable to read client secret file: %v\n%s", err, Instructions)
 	}
 
 	// If modifying these scopes, delete your previously saved token.json.
 	scopes := []string{gmail.GmailReadonlyScope}
-	token := "token.json"
-	if needWriteAccess {
+	if c.Write {
 		scopes = append(scopes, gmail.GmailModifyScope)
-		token = "token_rw.json"
 	}
 
 	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
-	return getClient(config, token)
+	return getClient(config, token.NewFileStore(c.Dir, c.Passphrase), TokenFile(c.Account, c.Write))
 }
 
 // Retrieve an OAuth token, saves it, then returns a pre-configured client.
-func getClient(config *oauth2.Config, tokFile string) *http.Client {
+func getClient(config *oauth2.Config, store *token.FileStore, tokFile string) *http.Client {
 	// The tokFile stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tok, err := token.FromFile(tokFile)
+	tok, err := store.Load(tokFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Unable to read the token: %v", err)
+	}
+	save := func(tok *oauth2.Token) {
+		log.Printf("Saving credential file to: %s\n", store.Path(tokFile))
+		if err := store.Save(tokFile, tok); err != nil {
+			log.Fatalf("Unable to cache oauth token: %v", err)
+		}
+	}
 	if err != nil {
 		tok = token.FromWeb(config)
-		token.Save(tokFile, tok)
+		save(tok)
+	}
+
+	// refreshed tokens are saved back, to keep working after the access token expires
+	ctx := context.Background()
+	saving := func(tok *oauth2.Token) oauth2.TokenSource {
+		return token.NewSavingSource(config.TokenSource(ctx, tok), tok, func(t *oauth2.Token) error {
+			return store.Save(tokFile, t)
+		})
+	}
+	ts := saving(tok)
+	if _, err := ts.Token(); token.IsReauth(err) {
+		log.Printf("The token in %s has expired or was revoked (%v), please authorize again", store.Path(tokFile), err)
+		tok = token.FromWeb(config)
+		save(tok)
+		ts = saving(tok)
 	}
-	return config.Client(context.Background(), tok)
+	return oauth2.NewClient(ctx, ts)
 }
 
 // FetchLabels fetches the list of labels, as returned by Gmail using authorized http Client.
@@ -93,9 +155,7 @@ func FetchLabels(ctx context.Context, client *http.Client) (
 		return nil, err
 	}
 
-	// TODO(bzz): handle token expiration (by cookie expiration? or set refresh token?)
-	// Unable to retrieve all labels: Get https://www.googleapis.com/gmail/v1/users/me/labels?alt=json&prettyPrint=false: oauth2: token expired and refresh token is not set
-
+	// expired tokens \wo a refresh one fail \w a token.ReauthError, if the client uses token.NewSavingSource
 	// fetch from Gmail
 	labelsResp, err := srv.Users.Labels.List("me").Do()
 	if err != nil {
@@ -104,85 +164,203 @@ func FetchLabels(ctx context.Context, client *http.Client) (
 	return labelsResp, nil
 }
 
-// PrintAllLabels prints all labels for a given user.
-func PrintAllLabels(srv *gmail.Service, user string) []*gmail.Label {
-	log.Printf("Listing all Gmail labels")
-	labelsResp, err := srv.Users.Labels.List(user).Do()
+// PrintAllLabels prints all labels from a given source.
+func PrintAllLabels(ctx context.Context, src MessageSource) []*gmail.Label {
+	log.Printf("Listing all labels")
+	labels, err := src.Labels(ctx)
 	if err != nil {
 		log.Fatalf("Unable to retrieve all labels: %v", err)
 	}
 
-	log.Printf("%d labels found", len(labelsResp.Labels))
-	for _, l := range labelsResp.Labels {
-		fmt.Println(FormatAsID(l.Name))
+	log.Printf("%d labels found", len(labels))
+	for _, l := range labels {
+		fmt.Println(l.Name)
 	}
-	return labelsResp.Labels
+	return labels
 }
 
-// FetchConcurent fetches matching messages for a given query in paralle from the Gmail.
-// It is blocking, but doing N concurrent fetche requests.
-// TODO(bzz): make it a method on the struct, that holds srv instance.
-func FetchConcurent(ctx context.Context, srv *gmail.Service, user, query string, concurentReq int) ([]*gmail.Message, error) {
-	log.Printf("searching and fetching messages from Gmail: %q", query)
+// FetchConcurent fetches matching messages for a given query in paralle from a source.
+// It is blocking, but doing N concurrent fetche requests for Gmail.
+func FetchConcurent(ctx context.Context, src MessageSource, query string) ([]*gmail.Message, error) {
+	log.Printf("searching and fetching messages: %q", query)
 	start := time.Now()
-	msgs, err := searchAndFetchConcurent(ctx, srv, user, query, concurentReq)
-	if err != nil {
+	msgs, err := FetchMessages(ctx, src, query)
+	if fe, ok := err.(*FetchError); ok { // still report the rest
+		log.Printf("Skipping %d messages: %v", len(fe.Errs), fe)
+	} else if err != nil {
 		return nil, err
 	}
 	log.Printf("%d messages found&fetched with (took %.0f sec)", len(msgs), time.Since(start).Seconds())
 	return msgs, nil
 }
 
-// TODO(bzz): make it a method on the struct, that holds srv instance.
-func searchAndFetchConcurent(ctx context.Context, srv *gmail.Service, user, query string, concurentReq int) ([]*gmail.Message, error) {
-	log.Printf("searching messages from Gmail: %q", query)
-	start := time.Now()
+// FetchAsync searches for the messages matching a query and streams them in the search order,
+// as soon as they are fetched, so the processing can start before all of them arrive.
+//
+// Errors channel receives exactly one value (nil on success) after the messages channel
+// is closed. A *FetchError means that only some messages were skipped.
+func FetchAsync(ctx context.Context, src MessageSource, query string) (<-chan *gmail.Message, <-chan error) {
+	out, errc := make(chan *gmail.Message), make(chan error, 1)
+	ids, err := src.Search(ctx, query)
+	if err != nil {
+		close(out)
+		errc <- err
+		return out, errc
+	}
 
-	// search
-	var msgIDs []string
-	err := srv.Users.Messages.List(user).Q(query).Pages(ctx, func(mr *gmail.ListMessagesResponse) error {
-		for _, msg := range mr.Messages {
-			msgIDs = append(msgIDs, msg.Id)
+	if as, ok := src.(asyncSource); ok {
+		return as.FetchAsync(ctx, ids)
+	}
+
+	go func() { // no streaming support, all at once
+		defer close(out)
+		msgs, err := src.Fetch(ctx, ids)
+		for _, m := range msgs {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
 		}
-		return nil
-	})
-	if err != nil {
-		log.Printf("Unable to list messages for query:%q - %v", query, err)
-		return nil, err
+		errc <- err
+	}()
+	return out, errc
+}
+
+// asyncSource is a MessageSource that can stream the fetched messages.
+type asyncSource interface {
+	FetchAsync(ctx context.Context, ids []string) (<-chan *gmail.Message, <-chan error)
+}
+
+// collect reads all the messages from a stream, returned by FetchAsync.
+func collect(msgs <-chan *gmail.Message, errc <-chan error) ([]*gmail.Message, error) {
+	var res []*gmail.Message
+	for m := range msgs {
+		res = append(res, m)
 	}
+	return res, <-errc
+}
 
-	log.Printf("%d messages found (took %.0f sec)", len(msgIDs), time.Since(start).Seconds())
-	start = time.Now()
-
-	// parallel fetch
-	bar := pb.Full.Start(len(msgIDs))
-	bar.SetMaxWidth(100)
-	var (
-		throttle = make(chan int, concurentReq)
-		wg       sync.WaitGroup
-		msgs     []*gmail.Message
-	)
-	for i := range msgIDs {
-		msgID := msgIDs[i]
-		wg.Add(1)
-		go func() {
-			throttle <- 1
-			defer func() { <-throttle; wg.Done() }()
+// fetchFunc fetches a single message by ID.
+type fetchFunc func(ctx context.Context, id string) (*gmail.Message, error)
 
-			bar.Increment()
-			msg, err := srv.Users.Messages.Get(user, msgID).Do()
-			if err != nil { // TODO(bzz): retry
-				log.Printf("Unable to fetch message by ID:%q", msgID)
+// batchFunc fetches a few messages at once, returning a message or an error for each ID.
+type batchFunc func(ctx context.Context, ids []string) ([]*gmail.Message, []error)
+
+// fetchAsync fetches messages by a pool of N workers and streams them in the given order.
+// Messages that failed to be fetched are skipped and reported by a *FetchError at the end.
+func fetchAsync(ctx context.Context, msgIDs []string, concurentReq int, fetch fetchFunc) (<-chan *gmail.Message, <-chan error) {
+	return fetchBatchesAsync(ctx, msgIDs, concurentReq, 1, single(fetch))
+}
+
+// single returns a batchFunc that fetches messages one by one.
+func single(fetch fetchFunc) batchFunc {
+	return func(ctx context.Context, ids []string) ([]*gmail.Message, []error) {
+		msgs, errs := make([]*gmail.Message, len(ids)), make([]error, len(ids))
+		for i, id := range ids {
+			msgs[i], errs[i] = fetch(ctx, id)
+		}
+		return msgs, errs
+	}
+}
+
+// fetchBatchesAsync is the same as fetchAsync, but every worker fetches a batch of messages at once.
+func fetchBatchesAsync(ctx context.Context, msgIDs []string, concurentReq, batchSize int, fetch batchFunc) (<-chan *gmail.Message, <-chan error) {
+	out, errc := make(chan *gmail.Message), make(chan error, 1)
+	if concurentReq < 1 {
+		concurentReq = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	type result struct {
+		msg *gmail.Message
+		err error
+	}
+	// a slot per message, so the results can be sent in order
+	results := make([]chan result, len(msgIDs))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	jobs := make(chan int) // first index of a batch, to feed the workers
+	go func() {
+		defer close(jobs)
+		for i := 0; i < len(msgIDs); i += batchSize {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
 			}
+		}
+	}()
 
-			msgs = append(msgs, msg)
+	for w := 0; w < concurentReq && w*batchSize < len(msgIDs); w++ {
+		go func() {
+			for start := range jobs {
+				end := start + batchSize
+				if end > len(msgIDs) {
+					end = len(msgIDs)
+				}
+				msgs, errs := fetch(ctx, msgIDs[start:end])
+				for i := range msgs {
+					results[start+i] <- result{msgs[i], errs[i]}
+				}
+			}
 		}()
 	}
-	wg.Wait()
-	bar.Finish()
 
-	log.Printf("%d messages fetched (took %.0f sec)", len(msgIDs), time.Since(start).Seconds())
-	return msgs, nil
+	go func() {
+		defer cancel()
+		defer close(out)
+		start := time.Now()
+		bar := pb.Full.Start(len(msgIDs))
+		bar.SetMaxWidth(100)
+		defer bar.Finish()
+
+		failed := &FetchError{Errs: map[string]error{}}
+		n := 0
+		for i, id := range msgIDs {
+			if ctx.Err() != nil {
+				errc <- ctx.Err()
+				return
+			}
+
+			var r result
+			select {
+			case r = <-results[i]:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+			bar.Increment()
+
+			if r.err != nil {
+				log.Printf("Unable to fetch message by ID:%q - %v", id, r.err)
+				failed.Errs[id] = r.err
+				continue
+			}
+
+			select {
+			case out <- r.msg:
+				n++
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+
+		log.Printf("%d messages fetched (took %.0f sec)", n, time.Since(start).Seconds())
+		if len(failed.Errs) != 0 {
+			errc <- failed
+			return
+		}
+		errc <- nil
+	}()
+	return out, errc
 }
 
 // ReadMsgFixturesJSON reads Gmail messages from a given JSON file.
@@ -213,108 +391,68 @@ func ReadLblFixturesJSON(name string) []*gmail.Label {
 	return msgs
 }
 
-// ModifyMsgsDelLabel batch-deletes a label from all the given messages.
-// TODO(bzz): move user to a const in this package
-func ModifyMsgsDelLabel(srv *gmail.Service, user string, messages []*gmail.Message, label string) {
-	var msgIds []string
-	for _, msg := range messages {
-		msgIds = append(msgIds, msg.Id)
+// ModifyMsgs batch-adds and removes labels, by names or IDs, of all the given messages.
+// Labels to add are created if missing, and the source supports it, see LabelCreator.
+// Gmail sources modify the messages in chunks of MaxModifyIDs.
+func ModifyMsgs(ctx context.Context, src MessageSource, messages []*gmail.Message, add, remove []string) error {
+	if len(messages) == 0 {
+		return nil
 	}
-
-	err := srv.Users.Messages.BatchModify(user, &gmail.BatchModifyMessagesRequest{
-		Ids:            msgIds,
-		RemoveLabelIds: []string{label},
-	}).Do()
+	addIDs, err := labelIDs(ctx, src, add, true)
 	if err != nil {
-		log.Printf("failed to batch-delete label %s from %d messages: %s",
-			label, len(messages), err)
+		return err
 	}
-}
-
-// FormatAsID formats human-readable lable as ID, consumable by Gmail API.
-func FormatAsID(label string) string {
-	// TODO(bzz): test with labels in on Gmail in Chinese/emoji
-	return strings.ToLower(strings.ReplaceAll(label, " ", "-"))
-}
-
-// Subject returns the Subject header of a message
-func Subject(m *gmail.MessagePart) string {
-	if m == nil {
-		return ""
+	removeIDs, err := labelIDs(ctx, src, remove, false)
+	if err != nil {
+		return err
 	}
 
-	for _, h := range m.Headers {
-		if h.Name == "Subject" {
-			return h.Value
-		}
+	log.Printf("modifying %d messages: adding labels %q, removing %q", len(messages), add, remove)
+	if err := src.Modify(ctx, MessageIDs(messages), addIDs, removeIDs); err != nil {
+		return fmt.Errorf("failed to modify labels of %d messages: %w", len(messages), err)
 	}
-	return ""
+	return nil
 }
 
-// NormalizeAndSplit normalizes subj format and split it to type/source.
-func NormalizeAndSplit(subj string) []string {
-	srcType, _ := splitOnDash(subj) // handles at least EN and FR locales
-	if len(srcType) != 2 {
-		srcType = splitOnRuLocale(subj)
-	}
-	return srcType
+// Trasher is a MessageSource that can move messages to the trash.
+type Trasher interface {
+	Trash(ctx context.Context, ids []string) error
 }
 
-type subjFormat struct{ ru, En string }
-
-var (
-	articles = subjFormat{
-		"Новые статьи пользователя ", "new articles",
-	}
-	citations = subjFormat{
-		": новые ссылки", "new citations",
-	}
-	related = subjFormat{
-		"Новые статьи, связанные с работами автора ", "new related research",
+// TrashMsgs moves all the given messages to the trash, if the source supports it, see Trasher.
+func TrashMsgs(ctx context.Context, src MessageSource, messages []*gmail.Message) error {
+	if len(messages) == 0 {
+		return nil
 	}
-	search = subjFormat{
-		"Новые результаты по запросу ", "new results",
+	t, ok := src.(Trasher)
+	if !ok {
+		return fmt.Errorf("moving messages to the trash: %w", ErrReadOnly)
 	}
-	// TODO(bzz): add this as well
-	// recomended = subjFormat{
-	// 	"Рекомендуемые статьи", "?????????",
-	// }
-)
 
-// splitOnRuLocale normalizes subj from RU locale.
-func splitOnRuLocale(s string) []string {
-	var result []string
+	log.Printf("moving %d messages to the trash", len(messages))
+	if err := t.Trash(ctx, MessageIDs(messages)); err != nil {
+		return fmt.Errorf("failed to move %d messages to the trash: %w", len(messages), err)
+	}
+	return nil
+}
 
-	switch {
-	case strings.HasSuffix(s, citations.ru):
-		result = []string{s[:strings.Index(s, citations.ru)], citations.En}
-	case s == "Новые ссылки на мои статьи":
-		result = []string{"me", citations.En}
-	case strings.HasPrefix(s, related.ru):
-		result = []string{s[len(related.ru):], related.En}
-	case strings.HasPrefix(s, search.ru):
-		result = []string{s[len(search.ru):], search.En}
-	case strings.HasPrefix(s, articles.ru):
-		result = []string{s[len(articles.ru):], articles.En}
-	}
-
-	return result
+// Subject returns the Subject header of a message
+func Subject(m *gmail.MessagePart) string {
+	return Header(m, "Subject")
 }
 
-// splitOnDash returns str, split on unicode Dash and a separator.
-func splitOnDash(str string) ([]string, string) {
-	s := str
-	dash := "-"
-	for len(s) > 0 {
-		r, size := utf8.DecodeRuneInString(s)
-		s = s[size:]
-		if unicode.In(r, unicode.Dash) {
-			dash = string(r)
-			break
+// Header returns the value of a first header \w a given name in the message
+func Header(m *gmail.MessagePart, name string) string {
+	if m == nil {
+		return ""
+	}
+
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
 		}
 	}
-	sep := fmt.Sprintf(" %s ", dash)
-	return strings.Split(str, sep), sep
+	return ""
 }
 
 // MessageTextBody returns the text (if any) of a given message ID
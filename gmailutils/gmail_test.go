@@ -1,46 +1,168 @@
 package gmailutils
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
 )
 
 func TestSubjSplit(t *testing.T) {
 	fixtures := []struct {
-		subj       string
-		src, typee string
+		subj string
+		src  string
+		kind AlertKind
 	}{
 		{
 			`Новые статьи, связанные с работами автора Mohamed ...`,
-			"Mohamed ...", related.En,
+			"Mohamed ...", Related,
 		},
 		{
 			`"Learning to represent programs with graphs" - new citations`,
-			`"Learning to represent programs with graphs"`, citations.En,
+			`"Learning to represent programs with graphs"`, Citations,
 		},
 		{
 			`"machine learning on code" – de nouveaux résultats sont disponibles`,
-			`"machine learning on code"`, "de nouveaux résultats sont disponibles", // TODO(bzz): normalize FR so it's search.En here
+			`"machine learning on code"`, Search,
 		},
 		{
 			`Новые статьи пользователя Diomidis Spinellis`,
-			"Diomidis Spinellis", articles.En,
+			"Diomidis Spinellis", Articles,
 		},
 		{
 			`Новые результаты по запросу "deep learning source code"`,
-			`"deep learning source code"`, search.En,
+			`"deep learning source code"`, Search,
 		},
-		// {
-		// 	`Рекомендуемые статьи`, "", recomended.En
-		// }
+		{
+			`Новые ссылки на мои статьи`,
+			"me", Citations,
+		},
+		{
+			`Рекомендуемые статьи`,
+			"", Recommended,
+		},
+		{
+			`Re: lunch`,
+			"", UnknownAlert,
+		},
+	}
+
+	for _, f := range fixtures {
+		src, kind := NormalizeAndSplit(f.subj)
+		assert.Equal(t, f.kind, kind, "%q parsing failed, result: %q %v", f.subj, src, kind)
+		assert.Equal(t, f.src, src)
+	}
+}
+
+func TestAlertKindText(t *testing.T) {
+	for k := UnknownAlert; k <= Recommended; k++ {
+		text, err := k.MarshalText()
+		assert.NoError(t, err)
+
+		var parsed AlertKind
+		assert.NoError(t, parsed.UnmarshalText(text))
+		assert.Equal(t, k, parsed)
+	}
+
+	kind, err := ParseAlertKind("citations")
+	assert.NoError(t, err)
+	assert.Equal(t, Citations, kind)
+
+	_, err = ParseAlertKind("spam")
+	assert.Error(t, err)
+}
+
+// TestSubjLocales checks subjects of real alerts, and some "unverified" ones that are
+// not copied from real alerts yet, so are to be replaced by such. The unsupported
+// "it" locale pins the fallback to the UnknownAlert kind.
+func TestSubjLocales(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/subjects.json")
+	require.NoError(t, err)
+
+	var fixtures []struct {
+		Lang, Subject, Source string
+		Kind                  AlertKind
 	}
+	require.NoError(t, json.Unmarshal(data, &fixtures))
 
+	kinds := map[string]map[AlertKind]bool{} // by language
 	for _, f := range fixtures {
-		srcType := NormalizeAndSplit(f.subj)
-		assert.Equal(t, 2, len(srcType), "%q parsing failed, restult: %+v", f.subj, srcType)
+		if kinds[f.Lang] == nil {
+			kinds[f.Lang] = map[AlertKind]bool{}
+		}
+		kinds[f.Lang][f.Kind] = true
+		t.Run(f.Lang, func(t *testing.T) {
+			src, kind := NormalizeAndSplit(f.Subject)
+			assert.Equal(t, f.Kind, kind, "%q", f.Subject)
+			assert.Equal(t, f.Source, src, "%q", f.Subject)
+		})
+	}
+
+	for _, lang := range []string{"en", "fr", "ru", "de", "es", "pt", "zh", "ja"} {
+		assert.Len(t, kinds[lang], int(Recommended), "all kinds of alerts must be covered for %q", lang)
+	}
+}
+
+func TestFetchAsyncOrder(t *testing.T) {
+	var ids []string
+	for i := 0; i < 50; i++ {
+		ids = append(ids, fmt.Sprintf("m%d", i))
+	}
+	fetch := func(ctx context.Context, id string) (*gmail.Message, error) {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		if id == "m7" {
+			return nil, fmt.Errorf("boom")
+		}
+		return &gmail.Message{Id: id}, nil
+	}
+
+	msgs, err := collect(fetchAsync(context.Background(), ids, 8, fetch))
+	require.Error(t, err)
+	assert.Equal(t, []string{"m7"}, err.(*FetchError).IDs())
 
-		assert.Equal(t, f.src, srcType[0])
-		assert.Equal(t, f.typee, srcType[1])
+	expected := append(append([]string{}, ids[:7]...), ids[8:]...)
+	assert.Equal(t, expected, MessageIDs(msgs))
+}
+
+func TestFetchAsyncCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ids := []string{"m1", "m2", "m3", "m4"}
+	fetch := func(ctx context.Context, id string) (*gmail.Message, error) {
+		if id == "m2" {
+			cancel()
+		}
+		return &gmail.Message{Id: id}, nil
 	}
+
+	msgs, errc := fetchAsync(ctx, ids, 1, fetch)
+	n := 0
+	for range msgs {
+		n++
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+	assert.True(t, n < len(ids), "must stop on cancellation, got %d messages", n)
+}
+
+func TestFetchAsyncSource(t *testing.T) {
+	src := NewFixturesSource("../fixtures")
+	msgs, err := collect(FetchAsync(context.Background(), src, "is:unread"))
+	require.NoError(t, err)
+
+	ids, err := src.Search(context.Background(), "is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, ids, MessageIDs(msgs))
+}
+
+func TestTokenFile(t *testing.T) {
+	assert.Equal(t, "token.json", TokenFile("", false))
+	assert.Equal(t, "token_rw.json", TokenFile("", true))
+	assert.Equal(t, "token_me@example.com.json", TokenFile("me@example.com", false))
+	assert.Equal(t, "token_rw_.._me.json", TokenFile("../me", true))
 }
@@ -0,0 +1,446 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// SyncSource is a Gmail source that keeps a local record of all the messages
+// under the labels it was searched for, and only fetches the changes since
+// the last search, using Gmail history API.
+//
+// The record is kept in a JSON file per account in a given directory,
+// so it is shared by all the sources of the same account e.g. in a web server.
+type SyncSource struct {
+	*GmailSource
+	dir string
+}
+
+// syncRecord is a local copy of all the messages under some labels.
+type syncRecord struct {
+	Labels map[string]*labelRecord // by label ID
+}
+
+type labelRecord struct {
+	HistoryID uint64                    // of the last sync
+	Synced    time.Time                 // time of the last sync
+	Msgs      map[string]*gmail.Message // by message ID, \w the same shape as the fixtures
+	Failed    []string                  // IDs of the messages that failed to be fetched, to retry
+}
+
+// syncLocks serialize the syncs of the same account, by path of the record.
+var syncLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+func lockRecord(path string) func() {
+	syncLocks.Lock()
+	mu, ok := syncLocks.m[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		syncLocks.m[path] = mu
+	}
+	syncLocks.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// NewSyncSource returns a Gmail source that records the messages in a given directory.
+func NewSyncSource(g *GmailSource, dir string) *SyncSource {
+	return &SyncSource{g, dir}
+}
+
+// Search syncs all the messages under the label of the query, and searches the local record.
+// Queries \wo a label, or \w terms not supported by parseQuery, are sent to Gmail as usual.
+func (s *SyncSource) Search(ctx context.Context, query string) ([]string, error) {
+	q, err := parseQuery(query)
+	if err != nil || q.label == "" {
+		return s.GmailSource.Search(ctx, query)
+	}
+
+	labels, err := s.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	label := FindLabel(labels, q.label)
+	if label == nil {
+		return s.GmailSource.Search(ctx, query)
+	}
+
+	rec, err := s.sync(ctx, label.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*gmail.Message
+	for _, m := range rec.Msgs {
+		if q.matches(m, labels) {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { // newest first, same as Gmail
+		if msgs[i].InternalDate != msgs[j].InternalDate {
+			return msgs[i].InternalDate > msgs[j].InternalDate
+		}
+		return msgs[i].Id < msgs[j].Id
+	})
+	return MessageIDs(msgs), nil
+}
+
+// Fetch returns the messages from the local record, fetching only the missing ones from Gmail.
+func (s *SyncSource) Fetch(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	profile, err := s.profile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path := s.path(profile.EmailAddress)
+	unlock := lockRecord(path)
+	rec, err := load(path)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	local := map[string]*gmail.Message{}
+	var missing []string
+	for _, id := range ids {
+		if m := rec.find(id); m != nil {
+			local[id] = m
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	fetched, err := s.GmailSource.Fetch(ctx, missing)
+	if _, ok := err.(*FetchError); err != nil && !ok {
+		return nil, err
+	}
+	for _, m := range fetched {
+		local[m.Id] = m
+	}
+
+	msgs := make([]*gmail.Message, 0, len(ids))
+	for _, id := range ids {
+		if m, ok := local[id]; ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, err
+}
+
+// FetchAsync streams the messages, returned by Fetch.
+func (s *SyncSource) FetchAsync(ctx context.Context, ids []string) (<-chan *gmail.Message, <-chan error) {
+	out, errc := make(chan *gmail.Message), make(chan error, 1)
+	go func() {
+		defer close(out)
+		msgs, err := s.Fetch(ctx, ids)
+		for _, m := range msgs {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+		errc <- err
+	}()
+	return out, errc
+}
+
+// Modify modifies the labels in Gmail, and in the local record.
+func (s *SyncSource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	if err := s.GmailSource.Modify(ctx, ids, add, remove); err != nil {
+		return err
+	}
+
+	profile, err := s.profile(ctx)
+	if err != nil {
+		return err
+	}
+	path := s.path(profile.EmailAddress)
+	defer lockRecord(path)()
+
+	rec, err := load(path)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		for _, lr := range rec.Labels {
+			if m, ok := lr.Msgs[id]; ok {
+				m.LabelIds = modifyLabels(m.LabelIds, add, remove)
+			}
+		}
+	}
+	return save(path, rec)
+}
+
+// Trash moves the messages to the trash in Gmail, and removes them from the local record.
+func (s *SyncSource) Trash(ctx context.Context, ids []string) error {
+	if err := s.GmailSource.Trash(ctx, ids); err != nil {
+		return err
+	}
+
+	profile, err := s.profile(ctx)
+	if err != nil {
+		return err
+	}
+	path := s.path(profile.EmailAddress)
+	defer lockRecord(path)()
+
+	rec, err := load(path)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		for _, lr := range rec.Labels {
+			delete(lr.Msgs, id)
+		}
+	}
+	return save(path, rec)
+}
+
+// sync brings the local record of a label up to date \w Gmail.
+func (s *SyncSource) sync(ctx context.Context, labelID string) (*labelRecord, error) {
+	profile, err := s.profile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path := s.path(profile.EmailAddress)
+	defer lockRecord(path)()
+
+	rec, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := rec.Labels[labelID]
+	if lr != nil {
+		err = s.syncHistory(ctx, labelID, lr)
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			log.Printf("history of label %q since %d is not available, doing a full sync", labelID, lr.HistoryID)
+			lr, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if lr == nil {
+		if lr, err = s.syncAll(ctx, labelID, profile.HistoryId); err != nil {
+			return nil, err
+		}
+		rec.Labels[labelID] = lr
+	}
+
+	lr.Synced = time.Now()
+	return lr, save(path, rec)
+}
+
+// syncAll fetches all the messages under a label.
+func (s *SyncSource) syncAll(ctx context.Context, labelID string, historyID uint64) (*labelRecord, error) {
+	log.Printf("syncing all messages under label %q", labelID)
+	var ids []string
+	err := s.backoff.Do(ctx, func() error {
+		ids = nil // start over
+		return s.srv.Users.Messages.List(s.user).LabelIds(labelID).Pages(ctx, func(mr *gmail.ListMessagesResponse) error {
+			for _, msg := range mr.Messages {
+				ids = append(ids, msg.Id)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lr := &labelRecord{HistoryID: historyID, Msgs: map[string]*gmail.Message{}}
+	return lr, s.fetchInto(ctx, lr, ids)
+}
+
+// syncHistory applies all the changes of messages under a label since the last sync.
+// Messages that failed to be fetched by the last sync are fetched again, unless deleted since.
+func (s *SyncSource) syncHistory(ctx context.Context, labelID string, lr *labelRecord) error {
+	added := map[string]bool{}
+	for _, id := range lr.Failed {
+		added[id] = true
+	}
+	historyID := lr.HistoryID
+	err := s.backoff.Do(ctx, func() error {
+		return s.srv.Users.History.List(s.user).StartHistoryId(lr.HistoryID).LabelId(labelID).
+			HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved").
+			Pages(ctx, func(resp *gmail.ListHistoryResponse) error {
+				for _, h := range resp.History {
+					applyHistory(lr, labelID, h, added)
+				}
+				historyID = resp.HistoryId
+				return nil
+			})
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for id := range added {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	log.Printf("%d new messages under label %q since the last sync", len(ids), labelID)
+
+	if err := s.fetchInto(ctx, lr, ids); err != nil {
+		return err
+	}
+	lr.HistoryID = historyID
+	return nil
+}
+
+// applyHistory updates the local record \w a history entry. IDs of the messages
+// that have to be fetched are collected to the added set.
+func applyHistory(lr *labelRecord, labelID string, h *gmail.History, added map[string]bool) {
+	for _, ma := range h.MessagesAdded {
+		if ma.Message != nil && (ma.Message.LabelIds == nil || contains(ma.Message.LabelIds, labelID)) {
+			added[ma.Message.Id] = true
+		}
+	}
+	for _, md := range h.MessagesDeleted {
+		if md.Message != nil {
+			delete(lr.Msgs, md.Message.Id)
+			delete(added, md.Message.Id)
+		}
+	}
+	for _, la := range h.LabelsAdded {
+		if la.Message == nil {
+			continue
+		}
+		if m, ok := lr.Msgs[la.Message.Id]; ok {
+			m.LabelIds = modifyLabels(m.LabelIds, la.LabelIds, nil)
+		} else if contains(la.LabelIds, labelID) {
+			added[la.Message.Id] = true
+		}
+	}
+	for _, rm := range h.LabelsRemoved {
+		if rm.Message == nil {
+			continue
+		}
+		id := rm.Message.Id
+		if contains(rm.LabelIds, labelID) {
+			delete(lr.Msgs, id)
+			delete(added, id)
+		} else if m, ok := lr.Msgs[id]; ok {
+			m.LabelIds = modifyLabels(m.LabelIds, nil, rm.LabelIds)
+		}
+	}
+}
+
+// fetchInto fetches the messages from Gmail into the label record.
+// Messages that failed to be fetched are skipped, and recorded to be fetched on the next sync.
+//
+// The cache is bypassed, as the label IDs of the cached messages may be out of date,
+// and is only updated \w the fetched messages.
+func (s *SyncSource) fetchInto(ctx context.Context, lr *labelRecord, ids []string) error {
+	msgs, err := collect(s.fetchAsync(ctx, ids, nil))
+	lr.Failed = nil
+	if fe, ok := err.(*FetchError); ok {
+		log.Printf("Skipping %d messages until the next sync: %v", len(fe.Errs), fe)
+		lr.Failed = fe.IDs()
+	} else if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		lr.Msgs[m.Id] = m
+		if s.cache != nil {
+			if err := s.cache.Put(m); err != nil {
+				log.Printf("Unable to cache message %q: %v", m.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SyncSource) path(account string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("sync-%s.json", account))
+}
+
+func (r *syncRecord) find(id string) *gmail.Message {
+	for _, lr := range r.Labels {
+		if m, ok := lr.Msgs[id]; ok {
+			return m
+		}
+	}
+	return nil
+}
+
+func load(path string) (*syncRecord, error) {
+	rec := &syncRecord{Labels: map[string]*labelRecord{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rec, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("failed to decode the sync record %s: %v", path, err)
+	}
+	return rec, nil
+}
+
+// save writes the record to a temporary file first, so it is never left half-written.
+func save(path string, rec *syncRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// modifyLabels returns label IDs \w the given ones added and removed.
+func modifyLabels(labelIds, add, remove []string) []string {
+	var res []string
+	for _, l := range labelIds {
+		if !contains(remove, l) && !contains(add, l) {
+			res = append(res, l)
+		}
+	}
+	for _, l := range add {
+		if !contains(remove, l) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
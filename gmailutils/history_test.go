@@ -0,0 +1,299 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+// fakeMailbox is a stand-in for Gmail API \w messages, labels and history.
+type fakeMailbox struct {
+	mu         sync.Mutex
+	msgs       map[string]*gmail.Message
+	history    []*gmail.History
+	historyID  uint64
+	minHistory uint64 // older history is not available
+	gets       int
+	lastQuery  string // of the last messages list
+	labels     []*gmail.Label
+	modifies   []*gmail.BatchModifyMessagesRequest
+	failing    map[string]bool // message IDs that fail to be fetched
+}
+
+func newFakeMailbox() *fakeMailbox {
+	return &fakeMailbox{msgs: map[string]*gmail.Message{}, historyID: 100, minHistory: 1, labels: []*gmail.Label{
+		{Id: "Label_1", Name: "Scholar"}, {Id: "UNREAD", Name: "UNREAD", Type: "system"},
+	}}
+}
+
+func (f *fakeMailbox) add(id string, date int64, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.historyID++
+	m := &gmail.Message{Id: id, InternalDate: date, LabelIds: labels}
+	f.msgs[id] = m
+	f.history = append(f.history, &gmail.History{Id: f.historyID,
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: id, LabelIds: labels}}}})
+}
+
+func (f *fakeMailbox) modify(id string, add, remove []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.msgs[id]
+	m.LabelIds = modifyLabels(m.LabelIds, add, remove)
+	f.historyID++
+	h := &gmail.History{Id: f.historyID}
+	if len(add) != 0 {
+		h.LabelsAdded = []*gmail.HistoryLabelAdded{{LabelIds: add, Message: &gmail.Message{Id: id}}}
+	}
+	if len(remove) != 0 {
+		h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{LabelIds: remove, Message: &gmail.Message{Id: id}}}
+	}
+	f.history = append(f.history, h)
+}
+
+func (f *fakeMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	switch {
+	case path == "profile":
+		enc.Encode(&gmail.Profile{EmailAddress: "me@example.com", HistoryId: f.historyID})
+	case path == "labels" && r.Method == http.MethodPost:
+		l := &gmail.Label{}
+		json.NewDecoder(r.Body).Decode(l)
+		l.Id = "Label_" + strconv.Itoa(len(f.labels)+1)
+		f.labels = append(f.labels, l)
+		enc.Encode(l)
+	case path == "labels":
+		enc.Encode(&gmail.ListLabelsResponse{Labels: f.labels})
+	case path == "messages/batchModify":
+		req := &gmail.BatchModifyMessagesRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.modifies = append(f.modifies, req)
+		for _, id := range req.Ids {
+			if m, ok := f.msgs[id]; ok {
+				m.LabelIds = modifyLabels(m.LabelIds, req.AddLabelIds, req.RemoveLabelIds)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "messages":
+		resp := &gmail.ListMessagesResponse{}
+		f.lastQuery = r.URL.Query().Get("q")
+		for id, m := range f.msgs {
+			if contains(m.LabelIds, r.URL.Query().Get("labelIds")) {
+				resp.Messages = append(resp.Messages, &gmail.Message{Id: id})
+			}
+		}
+		enc.Encode(resp)
+	case strings.HasPrefix(path, "messages/") && strings.HasSuffix(path, "/trash"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "messages/"), "/trash")
+		m := f.msgs[id]
+		f.historyID++
+		f.history = append(f.history, &gmail.History{Id: f.historyID,
+			LabelsRemoved: []*gmail.HistoryLabelRemoved{{LabelIds: m.LabelIds, Message: &gmail.Message{Id: id}}}})
+		m.LabelIds = []string{"TRASH"}
+		enc.Encode(m)
+	case strings.HasPrefix(path, "messages/"):
+		id := strings.TrimPrefix(path, "messages/")
+		if f.failing[id] {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(map[string]interface{}{"error": map[string]interface{}{"code": 500, "message": "backend error"}})
+			return
+		}
+		m, ok := f.msgs[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "not found"}})
+			return
+		}
+		f.gets++
+		enc.Encode(m)
+	case path == "history":
+		start, _ := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+		if start < f.minHistory {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "expired"}})
+			return
+		}
+		resp := &gmail.ListHistoryResponse{HistoryId: f.historyID}
+		for _, h := range f.history {
+			if h.Id > start {
+				resp.History = append(resp.History, h)
+			}
+		}
+		enc.Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestSyncSource(t *testing.T, f *fakeMailbox) *SyncSource {
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	g, err := NewGmailSource(ts.Client(), "me", 2)
+	require.NoError(t, err)
+	g.srv.BasePath = ts.URL + "/gmail/v1/users/"
+	g.backoff = Backoff{Retries: 1, Initial: time.Millisecond, Max: time.Millisecond}
+	g.batchSize = 1
+	return NewSyncSource(g, tempDir(t))
+}
+
+func TestSyncSource(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+	f.add("m2", 2, "Label_1")
+	f.add("other", 3, "INBOX", "UNREAD")
+
+	src := newTestSyncSource(t, f)
+	ids, err := src.Search(ctx, "label:scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1"}, ids)
+	assert.Equal(t, 2, f.gets, "first search must fetch all the messages under the label")
+
+	f.add("m3", 4, "Label_1", "UNREAD")
+	f.modify("m1", nil, []string{"UNREAD"})
+	f.modify("m2", nil, []string{"Label_1"})
+
+	// a new source, as in the next run, must only fetch the new message
+	src = NewSyncSource(src.GmailSource, src.dir)
+	ids, err = src.Search(ctx, "label:scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m3"}, ids)
+	assert.Equal(t, 3, f.gets)
+
+	ids, err = src.Search(ctx, "label:scholar is:read")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1"}, ids, "m2 is not under the label anymore")
+
+	msgs, err := src.Fetch(ctx, []string{"m3", "m1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m3", "m1"}, MessageIDs(msgs))
+	assert.Equal(t, 3, f.gets, "synced messages must be fetched from the local record")
+}
+
+func TestSyncSourceHistoryExpired(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+
+	src := newTestSyncSource(t, f)
+	_, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+
+	f.add("m2", 2, "Label_1", "UNREAD")
+	f.minHistory = f.historyID + 1
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m2", "m1"}, ids)
+	assert.Equal(t, 3, f.gets, "must fall back to a full sync")
+}
+
+func TestSyncSourceWithCache(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+
+	src := newTestSyncSource(t, f)
+	cache, err := NewCache(tempDir(t), 0, 0)
+	require.NoError(t, err)
+	src.SetCache(cache)
+
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1"}, ids)
+
+	// read in Gmail, while the history is not available any more
+	f.modify("m1", nil, []string{"UNREAD"})
+	f.minHistory = f.historyID + 1
+	ids, err = src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Empty(t, ids, "a full sync must not use the stale label IDs of the cache")
+
+	cached, ok := cache.Get("m1")
+	require.True(t, ok)
+	assert.NotContains(t, cached.LabelIds, "UNREAD", "cache is updated by the sync")
+}
+
+func TestSyncSourceTrash(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+	f.add("m2", 2, "Label_1", "UNREAD")
+
+	src := newTestSyncSource(t, f)
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	require.Equal(t, []string{"m2", "m1"}, ids)
+
+	require.NoError(t, TrashMsgs(ctx, src, []*gmail.Message{{Id: "m1"}}))
+	assert.Equal(t, []string{"TRASH"}, f.msgs["m1"].LabelIds)
+	assert.Empty(t, f.modifies, "no TRASH label is added by a batch modify")
+
+	ids, err = src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m2"}, ids)
+}
+
+func TestSyncSourceFetchFailed(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+
+	src := newTestSyncSource(t, f)
+	_, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+
+	f.add("m2", 2, "Label_1", "UNREAD")
+	f.add("m3", 3, "Label_1", "UNREAD")
+	f.failing = map[string]bool{"m2": true, "m3": true}
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1"}, ids, "failed messages are skipped")
+
+	// m3 is deleted meanwhile
+	f.failing = nil
+	f.historyID++
+	f.history = append(f.history, &gmail.History{Id: f.historyID,
+		MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "m3"}}}})
+	delete(f.msgs, "m3")
+
+	ids, err = src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m2", "m1"}, ids, "failed messages must be fetched on the next sync")
+
+	rec, err := load(src.path("me@example.com"))
+	require.NoError(t, err)
+	assert.Empty(t, rec.Labels["Label_1"].Failed, "deleted messages must not be fetched again")
+}
@@ -0,0 +1,390 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"google.golang.org/api/gmail/v1"
+)
+
+const inbox = "INBOX"
+
+// IMAPSource is a MessageSource backed by an IMAP server.
+//
+// Folders are used instead of Gmail labels, and the \Seen flag instead of UNREAD:
+//   - 'label:<folder>' selects a folder to search in, INBOX by default
+//   - 'is:unread' and 'is:read' search for UNSEEN and SEEN messages
+//   - removing UNREAD sets the \Seen flag, adding it - clears the flag
+//   - removing INBOX (or the current folder) moves messages to the archive folder
+//   - Trash moves messages to the folder \w the \Trash special-use attribute (RFC 6154)
+//
+// Message IDs have the form "<folder>/<uid>".
+type IMAPSource struct {
+	mu      sync.Mutex // IMAP client runs one command at a time
+	c       *client.Client
+	archive string
+}
+
+// DialIMAP connects and logs in to the IMAP server at addr.
+func DialIMAP(addr, username, password string, useTLS bool, archive string) (*IMAPSource, error) {
+	var (
+		c   *client.Client
+		err error
+	)
+	if useTLS {
+		c, err = client.DialTLS(addr, nil)
+	} else {
+		c, err = client.Dial(addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IMAP server %s: %v", addr, err)
+	}
+
+	if err := c.Login(username, password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("failed to login to IMAP server %s as %s: %v", addr, username, err)
+	}
+	return NewIMAPSource(c, archive), nil
+}
+
+// NewIMAPSource returns a source using already authenticated IMAP client.
+func NewIMAPSource(c *client.Client, archive string) *IMAPSource {
+	return &IMAPSource{c: c, archive: archive}
+}
+
+// Close logs out from the IMAP server.
+func (s *IMAPSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Logout()
+}
+
+// Labels lists all the folders.
+func (s *IMAPSource) Labels(ctx context.Context) ([]*gmail.Label, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() { done <- s.c.List("", "*", mailboxes) }()
+
+	var labels []*gmail.Label
+	for m := range mailboxes {
+		typee := "user"
+		if strings.EqualFold(m.Name, inbox) {
+			typee = "system"
+		}
+		labels = append(labels, &gmail.Label{Id: m.Name, Name: m.Name, Type: typee})
+	}
+	return labels, <-done
+}
+
+// Search returns IDs of the messages in a folder, matching the query.
+func (s *IMAPSource) Search(ctx context.Context, query string) ([]string, error) {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	folder := q.label
+	if folder == "" {
+		folder = inbox
+	}
+
+	criteria := imap.NewSearchCriteria()
+	if q.read != nil && *q.read {
+		criteria.WithFlags = []string{imap.SeenFlag}
+	} else if q.read != nil {
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+	}
+	if q.from != "" {
+		criteria.Header.Add("From", q.from)
+	}
+	criteria.Since, criteria.Before = q.after, q.before
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.c.Select(folder, true); err != nil {
+		return nil, fmt.Errorf("failed to select IMAP folder %q: %v", folder, err)
+	}
+	uids, err := s.c.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search IMAP folder %q: %v", folder, err)
+	}
+
+	ids := make([]string, len(uids))
+	for i, uid := range uids {
+		ids[i] = imapID(folder, uid)
+	}
+	log.Printf("%d messages found in IMAP folder %q", len(ids), folder)
+	return ids, nil
+}
+
+// Fetch returns full messages by IDs, without setting the \Seen flag.
+func (s *IMAPSource) Fetch(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	byFolder, folders, err := groupByFolder(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fetched := map[string]*gmail.Message{}
+	section := &imap.BodySectionName{Peek: true}
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := s.c.Select(folder, true); err != nil {
+			return nil, fmt.Errorf("failed to select IMAP folder %q: %v", folder, err)
+		}
+
+		imapMsgs := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, section.FetchItem()}
+		go func() { done <- s.c.UidFetch(byFolder[folder], items, imapMsgs) }()
+
+		for m := range imapMsgs {
+			id := imapID(folder, m.Uid)
+			body := m.GetBody(section)
+			if body == nil {
+				log.Printf("Skipping IMAP message %s: no body", id)
+				continue
+			}
+
+			msg, err := ParseRFC822(body)
+			if err != nil {
+				log.Printf("Skipping IMAP message %s: %v", id, err)
+				continue
+			}
+			msg.Id = id
+			msg.LabelIds = []string{folder}
+			if !hasFlag(m.Flags, imap.SeenFlag) {
+				msg.LabelIds = append(msg.LabelIds, "UNREAD")
+			}
+			fetched[id] = msg
+		}
+		if err := <-done; err != nil {
+			return nil, fmt.Errorf("failed to fetch from IMAP folder %q: %v", folder, err)
+		}
+	}
+
+	msgs := make([]*gmail.Message, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := fetched[id]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// CreateLabel creates a new folder.
+func (s *IMAPSource) CreateLabel(ctx context.Context, name string) (*gmail.Label, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.c.Create(name); err != nil {
+		return nil, err
+	}
+	return &gmail.Label{Id: name, Name: name, Type: "user"}, nil
+}
+
+// Modify toggles the \Seen flag for UNREAD and moves messages to the archive
+// folder for INBOX (or the folder messages are in).
+func (s *IMAPSource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	byFolder, folders, err := groupByFolder(ids)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := s.c.Select(folder, false); err != nil {
+			return fmt.Errorf("failed to select IMAP folder %q: %v", folder, err)
+		}
+
+		var archive bool
+		for _, l := range remove {
+			switch {
+			case l == "UNREAD":
+				err = s.storeSeen(byFolder[folder], imap.AddFlags)
+			case strings.EqualFold(l, inbox) || l == folder:
+				archive = true
+			default:
+				err = fmt.Errorf("removing label %q is not supported by IMAP", l)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, l := range add {
+			switch {
+			case l == "UNREAD":
+				err = s.storeSeen(byFolder[folder], imap.RemoveFlags)
+			default:
+				err = s.c.UidCopy(byFolder[folder], l)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to add label %q in IMAP folder %q: %v", l, folder, err)
+			}
+		}
+
+		if archive && folder != s.archive {
+			if err := s.move(byFolder[folder], s.archive); err != nil {
+				return fmt.Errorf("failed to move from IMAP folder %q to %q: %v", folder, s.archive, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Trash moves the given messages to the trash folder of the server.
+func (s *IMAPSource) Trash(ctx context.Context, ids []string) error {
+	byFolder, folders, err := groupByFolder(ids)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trash, err := s.trashFolder()
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if folder == trash {
+			continue
+		}
+		if _, err := s.c.Select(folder, false); err != nil {
+			return fmt.Errorf("failed to select IMAP folder %q: %v", folder, err)
+		}
+		if err := s.move(byFolder[folder], trash); err != nil {
+			return fmt.Errorf("failed to move from IMAP folder %q to %q: %v", folder, trash, err)
+		}
+	}
+	return nil
+}
+
+// trashFolder returns the name of the folder \w the \Trash attribute.
+func (s *IMAPSource) trashFolder() (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() { done <- s.c.List("", "*", mailboxes) }()
+
+	var trash string
+	for m := range mailboxes {
+		if trash == "" && contains(m.Attributes, imap.TrashAttr) {
+			trash = m.Name
+		}
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+	if trash == "" {
+		return "", fmt.Errorf("no IMAP folder with the %s attribute", imap.TrashAttr)
+	}
+	return trash, nil
+}
+
+// move uses MOVE, falling back to COPY, STORE \Deleted and UID EXPUNGE (UIDPLUS)
+// of only the moved messages, so no others, flagged \Deleted e.g. by another client, are expunged.
+func (s *IMAPSource) move(uids *imap.SeqSet, dest string) error {
+	if ok, err := s.c.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		return s.c.UidMove(uids, dest)
+	}
+	if ok, err := s.c.Support("UIDPLUS"); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("moving messages requires MOVE or UIDPLUS, not supported by the IMAP server")
+	}
+
+	if err := s.c.UidCopy(uids, dest); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := s.c.UidStore(uids, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{uids}}}
+	status, err := s.c.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func (s *IMAPSource) storeSeen(uids *imap.SeqSet, op imap.FlagsOp) error {
+	item := imap.FormatFlagsOp(op, true)
+	return s.c.UidStore(uids, item, []interface{}{imap.SeenFlag}, nil)
+}
+
+func imapID(folder string, uid uint32) string {
+	return fmt.Sprintf("%s/%d", folder, uid)
+}
+
+// groupByFolder groups message IDs into UID sets by folder, keeping the order of folders.
+func groupByFolder(ids []string) (map[string]*imap.SeqSet, []string, error) {
+	byFolder := map[string]*imap.SeqSet{}
+	var folders []string
+	for _, id := range ids {
+		i := strings.LastIndex(id, "/")
+		uid, err := strconv.ParseUint(id[i+1:], 10, 32)
+		if i < 0 || err != nil {
+			return nil, nil, fmt.Errorf("not an IMAP message ID %q", id)
+		}
+
+		folder := id[:i]
+		if _, ok := byFolder[folder]; !ok {
+			byFolder[folder] = new(imap.SeqSet)
+			folders = append(folders, folder)
+		}
+		byFolder[folder].AddNum(uint32(uid))
+	}
+	return byFolder, folders, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
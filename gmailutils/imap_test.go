@@ -0,0 +1,205 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend adds MOVE to the in-memory backend, as its server advertises it anyway,
+// and the \Trash attribute to a "Trash" folder.
+type testBackend struct {
+	*memory.Backend
+}
+
+func (b testBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := b.Backend.Login(info, username, password)
+	return testUser{u}, err
+}
+
+type testUser struct {
+	backend.User
+}
+
+func (u testUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range mboxes {
+		mboxes[i] = testMailbox{mbox.(*memory.Mailbox)}
+	}
+	return mboxes, err
+}
+
+func (u testUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return testMailbox{mbox.(*memory.Mailbox)}, nil
+}
+
+type testMailbox struct {
+	*memory.Mailbox
+}
+
+func (mbox testMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := mbox.Mailbox.Info()
+	if err == nil && mbox.Name() == "Trash" {
+		info.Attributes = append(info.Attributes, imap.TrashAttr)
+	}
+	return info, err
+}
+
+func (mbox testMailbox) MoveMessages(uid bool, uids *imap.SeqSet, dest string) error {
+	if err := mbox.CopyMessages(uid, uids, dest); err != nil {
+		return err
+	}
+	var left []*memory.Message
+	for _, m := range mbox.Messages {
+		if !uids.Contains(m.Uid) {
+			left = append(left, m)
+		}
+	}
+	mbox.Messages = left
+	return nil
+}
+
+// newTestIMAPSource starts an in-process IMAP server \w a "Scholar" folder,
+// populated by a read and an unread alert messages.
+func newTestIMAPSource(t *testing.T) *IMAPSource {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := server.New(testBackend{memory.New()})
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	src, err := DialIMAP(l.Addr().String(), "username", "password", false, "Archive")
+	require.NoError(t, err)
+	t.Cleanup(func() { src.Close() })
+
+	c := src.c
+	require.NoError(t, c.Create("Scholar"))
+	require.NoError(t, c.Create("Archive"))
+	for _, m := range []struct {
+		raw   string
+		flags []string
+	}{{qpMsg, []string{imap.SeenFlag}}, {b64Msg, nil}} {
+		raw := bytes.NewBufferString(strings.Replace(m.raw, "\n", "\r\n", -1))
+		require.NoError(t, c.Append("Scholar", m.flags, time.Now(), raw))
+	}
+	return src
+}
+
+func TestIMAPSource(t *testing.T) {
+	ctx := context.Background()
+	src := newTestIMAPSource(t)
+
+	labels, err := src.Labels(ctx)
+	require.NoError(t, err)
+	assert.Len(t, labels, 3)
+
+	msgs, err := FetchMessages(ctx, src, `label:Scholar is:unread`)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "Scholar/2", msgs[0].Id)
+	assert.Contains(t, msgs[0].LabelIds, "UNREAD")
+	assert.Contains(t, Subject(msgs[0].Payload), "new citations")
+
+	// fetching does not mark as read
+	ids, err := src.Search(ctx, `label:Scholar is:unread`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Scholar/2"}, ids)
+
+	ids, err = src.Search(ctx, `label:"Scholar" from:scholaralerts-noreply`)
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+}
+
+func TestIMAPSourceModify(t *testing.T) {
+	ctx := context.Background()
+	src := newTestIMAPSource(t)
+
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	require.NoError(t, src.Modify(ctx, ids, nil, []string{"UNREAD"}))
+	unread, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	assert.Empty(t, unread)
+
+	// another message is flagged \Deleted, but not expunged yet e.g. by another client
+	_, err = src.c.Select("Scholar", false)
+	require.NoError(t, err)
+	other, deleted := new(imap.SeqSet), imap.FormatFlagsOp(imap.AddFlags, true)
+	other.AddNum(1)
+	require.NoError(t, src.c.UidStore(other, deleted, []interface{}{imap.DeletedFlag}, nil))
+
+	require.NoError(t, src.Modify(ctx, ids, nil, []string{"INBOX"}))
+	left, err := src.Search(ctx, "label:Scholar")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Scholar/1"}, left, "only the archived message is gone")
+
+	archived, err := FetchMessages(ctx, src, "label:Archive is:read")
+	require.NoError(t, err)
+	require.Len(t, archived, 1)
+	assert.Contains(t, Subject(archived[0].Payload), "new citations")
+
+	assert.Error(t, src.Modify(ctx, left, nil, []string{"STARRED"}))
+	assert.Error(t, src.Modify(ctx, []string{"not-an-id"}, nil, []string{"UNREAD"}))
+}
+
+func TestIMAPSourceTrash(t *testing.T) {
+	ctx := context.Background()
+	src := newTestIMAPSource(t)
+
+	ids, err := src.Search(ctx, "label:Scholar is:unread")
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	assert.Error(t, src.Trash(ctx, ids), "there is no trash folder yet")
+
+	require.NoError(t, src.c.Create("Trash"))
+	require.NoError(t, src.Trash(ctx, ids))
+	left, err := src.Search(ctx, "label:Scholar")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Scholar/1"}, left)
+
+	trashed, err := FetchMessages(ctx, src, "label:Trash")
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	assert.Contains(t, Subject(trashed[0].Payload), "new citations")
+
+	labels, err := src.Labels(ctx)
+	require.NoError(t, err)
+	assert.Len(t, labels, 4, "no folder is created for the TRASH label")
+}
+
+var _ MessageSource = (*IMAPSource)(nil)
+var _ Trasher = (*IMAPSource)(nil)
@@ -0,0 +1,180 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// SplitLabels splits a comma-separated list of labels.
+func SplitLabels(s string) []string {
+	var labels []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// IsLabelGlob returns true if a label contains '*' or '?' wildcards.
+func IsLabelGlob(label string) bool {
+	return strings.ContainsAny(label, "*?")
+}
+
+// FindLabel returns the label \w a given ID or name, if any. Names are matched
+// exactly first, and then case-insensitively, as Gmail does.
+//
+// The legacy search format of names e.g. "[-oss-]-_ml-in-se" for "[ OSS ]/_ML-in-SE"
+// is matched as well, to keep the previously saved labels working.
+func FindLabel(labels []*gmail.Label, name string) *gmail.Label {
+	for _, match := range []func(*gmail.Label) bool{
+		func(l *gmail.Label) bool { return l.Id == name || l.Name == name },
+		func(l *gmail.Label) bool { return strings.EqualFold(l.Name, name) },
+		func(l *gmail.Label) bool { return strings.EqualFold(legacySearchName(l.Name), name) },
+	} {
+		for _, l := range labels {
+			if match(l) {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// legacySearchName formats a label name the way Gmail search used to accept it.
+func legacySearchName(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "-", "/", "-").Replace(name))
+}
+
+// ExpandLabels resolves the given label names (or IDs) to the names of the labels of the source,
+// and replaces each label glob e.g. "research/*" by all the matching names, sorted.
+// Only '*' and '?' are wildcards, matching names case-insensitively.
+// The result has no duplicates.
+func ExpandLabels(ctx context.Context, src MessageSource, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	labels, err := src.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, p := range patterns {
+		if !IsLabelGlob(p) {
+			l := FindLabel(labels, p)
+			if l == nil {
+				return nil, fmt.Errorf("no label %q", p)
+			}
+			add(l.Name)
+			continue
+		}
+
+		re := globRegexp(p)
+		var matched []string
+		for _, l := range labels {
+			if re.MatchString(l.Name) {
+				matched = append(matched, l.Name)
+			}
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no labels match %q", p)
+		}
+		sort.Strings(matched)
+		for _, name := range matched {
+			add(name)
+		}
+	}
+	return names, nil
+}
+
+// LabelCreator is a MessageSource that can create new labels.
+type LabelCreator interface {
+	CreateLabel(ctx context.Context, name string) (*gmail.Label, error)
+}
+
+// systemLabels are never created, as every mailbox has them in some form.
+var systemLabels = []string{"INBOX", "UNREAD", "STARRED", "IMPORTANT", "TRASH", "SPAM"}
+
+// labelIDs resolves label names of the source to IDs, see FindLabel. Missing labels
+// are created if create is set and the source is a LabelCreator, or kept as is otherwise.
+func labelIDs(ctx context.Context, src MessageSource, names []string, create bool) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	labels, err := src.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		if l := FindLabel(labels, name); l != nil {
+			ids = append(ids, l.Id)
+			continue
+		}
+
+		lc, ok := src.(LabelCreator)
+		if !create || !ok || contains(systemLabels, name) {
+			ids = append(ids, name)
+			continue
+		}
+		l, err := lc.CreateLabel(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create label %q: %w", name, err)
+		}
+		log.Printf("created label %q", name)
+		labels = append(labels, l)
+		ids = append(ids, l.Id)
+	}
+	return ids, nil
+}
+
+// globRegexp compiles a label glob, quoting everything but the wildcards, as
+// label names often contain e.g. brackets.
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
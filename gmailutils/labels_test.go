@@ -0,0 +1,136 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/bzz/scholar-alert-digest/gmailutils/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestExpandLabels(t *testing.T) {
+	ctx := context.Background()
+	src := NewFixturesSource("../fixtures")
+
+	assert.Equal(t, []string{"a", "b c"}, SplitLabels(" a,b c,, "))
+
+	labels, err := ExpandLabels(ctx, src, []string{"*ml-in-se", "[ OSS ]/_ML-in-SE", "INBOX"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[ OSS ]/_ML-in-SE", "_test-ML-in-SE", "INBOX"}, labels)
+
+	labels, err = ExpandLabels(ctx, src, []string{"[ OSS ]/*"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[ OSS ]/_ML-in-SE"}, labels)
+
+	_, err = ExpandLabels(ctx, src, []string{"no-such-*"})
+	assert.Error(t, err)
+}
+
+func TestFindLabel(t *testing.T) {
+	labels := []*gmail.Label{
+		{Id: "Label_1", Name: "[ OSS ]/_ML-in-SE"},
+		{Id: "Label_2", Name: "論文/😀 ML"},
+		{Id: "Label_3", Name: "ml"},
+		{Id: "Label_4", Name: "ML"},
+	}
+
+	var cases = []struct {
+		name, id string
+	}{
+		{"Label_2", "Label_2"},
+		{"[ OSS ]/_ML-in-SE", "Label_1"},
+		{"[ oss ]/_ml-in-se", "Label_1"},
+		{"[-oss-]-_ml-in-se", "Label_1"},
+		{"論文/😀 ML", "Label_2"},
+		{"論文/😀 ml", "Label_2"},
+		{"ML", "Label_4"},
+		{"Ml", "Label_3"},
+	}
+	for _, c := range cases {
+		l := FindLabel(labels, c.name)
+		if assert.NotNil(t, l, c.name) {
+			assert.Equal(t, c.id, l.Id, c.name)
+		}
+	}
+	assert.Nil(t, FindLabel(labels, "no such label"))
+}
+
+func TestGmailSearchByLabelID(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "UNREAD")
+	f.add("other", 2, "INBOX", "UNREAD")
+
+	src := newTestSyncSource(t, f).GmailSource
+	ids, err := src.Search(ctx, `label:"scholar" from:scholaralerts-noreply is:unread`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1"}, ids)
+	assert.Equal(t, "from:scholaralerts-noreply is:unread", f.lastQuery)
+
+	_, err = src.Search(ctx, "label:no-such-label")
+	assert.Error(t, err)
+}
+
+func TestModifyMsgs(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeMailbox()
+	f.add("m1", 1, "Label_1", "INBOX", "UNREAD")
+	msgs := []*gmail.Message{{Id: "m1"}}
+	for i := 0; i < MaxModifyIDs+10; i++ {
+		msgs = append(msgs, &gmail.Message{Id: "missing-" + strconv.Itoa(i)})
+	}
+
+	src := newTestSyncSource(t, f).GmailSource
+	err := ModifyMsgs(ctx, src, msgs, []string{"Scholar/Processed"}, []string{"UNREAD", "INBOX", "scholar"})
+	require.NoError(t, err)
+
+	require.Len(t, f.labels, 3, "missing label must be created")
+	assert.Equal(t, "Scholar/Processed", f.labels[2].Name)
+	assert.Equal(t, []string{"Label_3"}, f.msgs["m1"].LabelIds)
+
+	require.Len(t, f.modifies, 2, "must be chunked by MaxModifyIDs")
+	assert.Len(t, f.modifies[0].Ids, MaxModifyIDs)
+	assert.Len(t, f.modifies[1].Ids, 11)
+	assert.Equal(t, []string{"UNREAD", "INBOX", "Label_1"}, f.modifies[1].RemoveLabelIds)
+
+	// label exists now
+	f.modifies = nil
+	require.NoError(t, ModifyMsgs(ctx, src, msgs[:1], []string{"scholar/processed"}, nil))
+	assert.Len(t, f.labels, 3)
+	assert.Equal(t, []string{"Label_3"}, f.modifies[0].AddLabelIds)
+
+	err = ModifyMsgs(ctx, NewMemorySource(nil, nil), msgs[:1], []string{"STARRED"}, nil)
+	assert.Error(t, err, "errors must be returned")
+
+	err = ModifyMsgs(ctx, expiredSource{NewMemorySource(nil, msgs[:1])}, msgs[:1], nil, []string{"UNREAD"})
+	assert.True(t, token.IsReauth(err), "errors must be wrapped: %v", err)
+}
+
+// expiredSource fails to modify messages, as \w a token that can not be refreshed.
+type expiredSource struct {
+	*MemorySource
+}
+
+func (expiredSource) Modify(context.Context, []string, []string, []string) error {
+	return &token.ReauthError{Err: errors.New("invalid_grant")}
+}
@@ -0,0 +1,234 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ErrReadOnly is returned by the sources that do not support modification of messages.
+var ErrReadOnly = errors.New("message source is read-only")
+
+// MboxSource is a read-only MessageSource of messages from a local mbox file.
+//
+// Messages without 'R' in the Status header are considered unread.
+// There are no labels, so only the search terms that are not 'label:' are supported.
+type MboxSource struct {
+	*MemorySource
+}
+
+// NewMboxSource reads all messages from an mbox file at a given path.
+func NewMboxSource(path string) (*MboxSource, error) {
+	log.Printf("reading messages from mbox %s instead of fetching from Gmail", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raws, err := splitMbox(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mbox %s: %v", path, err)
+	}
+
+	var msgs []*gmail.Message
+	for i, raw := range raws {
+		msg, err := ParseRFC822(bytes.NewReader(raw))
+		if err != nil {
+			log.Printf("Skipping message #%d in %s: %v", i, path, err)
+			continue
+		}
+		if msg.Id == "" {
+			msg.Id = fmt.Sprintf("%s#%d", filepath.Base(path), i)
+		}
+		if !strings.ContainsRune(Header(msg.Payload, "Status"), 'R') {
+			msg.LabelIds = []string{"UNREAD"}
+		}
+		msgs = append(msgs, msg)
+	}
+	return &MboxSource{NewMemorySource(nil, msgs)}, nil
+}
+
+// Modify is not supported for mbox files.
+func (m *MboxSource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	return ErrReadOnly
+}
+
+// Trash is not supported for mbox files.
+func (m *MboxSource) Trash(ctx context.Context, ids []string) error {
+	return ErrReadOnly
+}
+
+// splitMbox splits mbox content into raw messages, on "From " separator lines.
+// Quoted ">From " lines of mboxrd format are un-escaped.
+func splitMbox(r io.Reader) ([][]byte, error) {
+	var (
+		msgs [][]byte
+		cur  *bytes.Buffer
+		br   = bufio.NewReader(r)
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if cur != nil {
+					msgs = append(msgs, cur.Bytes())
+				}
+				cur = &bytes.Buffer{}
+			case cur == nil:
+				return nil, errors.New("not an mbox: missing the first 'From ' line")
+			case bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")):
+				cur.Write(line[1:])
+			default:
+				cur.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cur != nil {
+		msgs = append(msgs, cur.Bytes())
+	}
+	return msgs, nil
+}
+
+// MaildirSource is a MessageSource of messages from a local Maildir.
+//
+// Messages in "new" or without the 'S' (seen) flag in "cur" are considered unread.
+// Only adding/removing "UNREAD" is supported on modification, by toggling the 'S' flag.
+type MaildirSource struct {
+	*MemorySource
+	dir   string
+	files map[string]string // message ID -> path, relative to dir
+}
+
+// NewMaildirSource reads all messages from a Maildir at a given path.
+func NewMaildirSource(dir string) (*MaildirSource, error) {
+	log.Printf("reading messages from maildir %s instead of fetching from Gmail", dir)
+	md := &MaildirSource{dir: dir, files: map[string]string{}}
+
+	var msgs []*gmail.Message
+	for _, sub := range []string{"new", "cur"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, fmt.Errorf("not a maildir %s: %v", dir, err)
+		}
+
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			name := filepath.Join(sub, info.Name())
+			msg, err := readMaildirMsg(filepath.Join(dir, name))
+			if err != nil {
+				log.Printf("Skipping message %s: %v", name, err)
+				continue
+			}
+			key, flags := maildirFlags(info.Name())
+			if msg.Id == "" {
+				msg.Id = key
+			}
+			if sub == "new" || !strings.ContainsRune(flags, 'S') {
+				msg.LabelIds = []string{"UNREAD"}
+			}
+			md.files[msg.Id] = name
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].InternalDate < msgs[j].InternalDate })
+	md.MemorySource = NewMemorySource(nil, msgs)
+	return md, nil
+}
+
+func readMaildirMsg(path string) (*gmail.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRFC822(f)
+}
+
+// Trash is not supported for Maildir, only the 'S' flag of the files is changed.
+func (m *MaildirSource) Trash(ctx context.Context, ids []string) error {
+	return ErrReadOnly
+}
+
+// Modify marks messages as read/unread by renaming the files \w updated 'S' flag.
+func (m *MaildirSource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	for _, l := range append(append([]string{}, add...), remove...) {
+		if l != "UNREAD" {
+			return fmt.Errorf("label %q: %v", l, ErrReadOnly)
+		}
+	}
+	seen := contains(remove, "UNREAD")
+
+	for _, id := range ids {
+		name, ok := m.files[id]
+		if !ok {
+			return fmt.Errorf("message %q not found", id)
+		}
+
+		key, flags := maildirFlags(filepath.Base(name))
+		flags = strings.Replace(flags, "S", "", -1)
+		if seen {
+			flags += "S"
+		}
+		newName := filepath.Join("cur", key+":2,"+sortFlags(flags))
+
+		err := os.Rename(filepath.Join(m.dir, name), filepath.Join(m.dir, newName))
+		if err != nil {
+			return err
+		}
+		m.files[id] = newName
+	}
+	return m.MemorySource.Modify(ctx, ids, add, remove)
+}
+
+// maildirFlags splits Maildir file name "<key>:2,<flags>" to the key and the flags.
+func maildirFlags(name string) (string, string) {
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+len(":2,"):]
+}
+
+func sortFlags(flags string) string {
+	r := []rune(flags)
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	return string(r)
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	qpMsg = `From: Google Scholar Alerts <scholaralerts-noreply@google.com>
+Subject: =?UTF-8?B?0J3QvtCy0YvQtSDRgdGC0LDRgtGM0Lgg0L/QvtC70YzQt9C+0LLQsNGC0LXQu9GPIA==?=
+ =?UTF-8?B?RGlvbWlkaXMgU3BpbmVsbGlz?=
+Date: Tue, 10 Dec 2019 11:24:26 -0800
+Message-ID: <qp@google.com>
+Status: RO
+Content-Type: multipart/alternative; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+Learning to Represent Edits
+--b1
+Content-Type: text/html; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+<h3><a href=3D"http://scholar.google.com/scholar_url?url=3Dhttps://arxiv.or=
+g/pdf/1810.13337&amp;hl=3Den">Learning to Represent Edits</a></h3>
+--b1--
+`
+	b64Msg = `From: Google Scholar Alerts <scholaralerts-noreply@google.com>
+Subject: "Learning to represent programs with graphs" - new citations
+Date: Wed, 11 Dec 2019 11:24:26 -0800
+Content-Type: text/html; charset="koi8-r"
+Content-Transfer-Encoding: base64
+
+PGgzPvfZ3snTzMXOydE8L2gzPg==
+`
+)
+
+func TestParseRFC822(t *testing.T) {
+	msg, err := ParseRFC822(strings.NewReader(qpMsg))
+	require.NoError(t, err)
+
+	assert.Equal(t, "qp@google.com", msg.Id)
+	assert.Equal(t, "Новые статьи пользователя Diomidis Spinellis", Subject(msg.Payload))
+	assert.Len(t, msg.Payload.Parts, 2)
+
+	body, err := MessageTextBody(msg.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, `<h3><a href="http://scholar.google.com/scholar_url?url=https://arxiv.org/pdf/1810.13337&amp;hl=en">Learning to Represent Edits</a></h3>`, string(body))
+
+	msg, err = ParseRFC822(strings.NewReader(b64Msg))
+	require.NoError(t, err)
+	body, err = MessageTextBody(msg.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, "<h3>Вычисления</h3>", string(body))
+}
+
+func TestMboxSource(t *testing.T) {
+	mbox := "From MAILER-DAEMON Tue Dec 10 11:24:26 2019\n" + qpMsg +
+		"\nFrom MAILER-DAEMON Wed Dec 11 11:24:26 2019\n" + b64Msg
+
+	path := filepath.Join(tempDir(t), "scholar.mbox")
+	require.NoError(t, ioutil.WriteFile(path, []byte(mbox), 0600))
+
+	src, err := NewMboxSource(path)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	msgs, err := FetchMessages(ctx, src, "is:unread")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "scholar.mbox#1", msgs[0].Id)
+
+	assert.Equal(t, ErrReadOnly, src.Modify(ctx, MessageIDs(msgs), nil, []string{"UNREAD"}))
+	assert.True(t, errors.Is(TrashMsgs(ctx, src, msgs), ErrReadOnly))
+}
+
+func TestMaildirSource(t *testing.T) {
+	dir := tempDir(t)
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, sub), 0700))
+	}
+	write := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	write("new/1575.b64", b64Msg)
+	write("cur/1576.qp:2,S", qpMsg)
+
+	src, err := NewMaildirSource(dir)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	ids, err := src.Search(ctx, "is:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1575.b64"}, ids)
+
+	require.NoError(t, src.Modify(ctx, ids, nil, []string{"UNREAD"}))
+	_, err = os.Stat(filepath.Join(dir, "cur", "1575.b64:2,S"))
+	assert.NoError(t, err)
+
+	ids, err = src.Search(ctx, "is:unread")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	assert.Error(t, src.Modify(ctx, []string{"qp@google.com"}, nil, []string{"INBOX"}))
+	assert.Equal(t, ErrReadOnly, src.Trash(ctx, []string{"1576.qp"}))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gmailutils")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
@@ -0,0 +1,198 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AlertKind is a type of Google Scholar alert, the reason a paper was sent.
+type AlertKind int
+
+// All kinds of alerts, known to NormalizeAndSplit.
+const (
+	UnknownAlert AlertKind = iota
+	Citations              // new citations of an article, or of the user's own articles
+	Articles               // new articles by an author
+	Related                // new research, related to the works of an author
+	Search                 // new results of a search query
+	Recommended            // recommended articles, based on the user's profile
+)
+
+// alertKinds are names of the kinds, same as in the EN locale subjects, and short ones.
+var alertKinds = []struct{ En, short string }{
+	UnknownAlert: {"unknown", "unknown"},
+	Citations:    {"new citations", "citations"},
+	Articles:     {"new articles", "articles"},
+	Related:      {"new related research", "related"},
+	Search:       {"new results", "search"},
+	Recommended:  {"recommended articles", "recommended"},
+}
+
+func (k AlertKind) String() string {
+	if k < 0 || int(k) >= len(alertKinds) {
+		return alertKinds[UnknownAlert].En
+	}
+	return alertKinds[k].En
+}
+
+// MarshalText encodes the kind the same way as in the EN locale subjects.
+func (k AlertKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes the kind, encoded by MarshalText.
+func (k *AlertKind) UnmarshalText(text []byte) error {
+	kind, err := ParseAlertKind(string(text))
+	*k = kind
+	return err
+}
+
+// ParseAlertKind returns the kind by it's name in EN locale e.g. "new citations",
+// or a short name e.g. "citations".
+func ParseAlertKind(name string) (AlertKind, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for k, n := range alertKinds {
+		if name == n.En || name == n.short {
+			return AlertKind(k), nil
+		}
+	}
+	return UnknownAlert, fmt.Errorf("unknown alert kind %q", name)
+}
+
+// subjFormat is a format of the alert subject: prefix + source + suffix.
+// Subjects that have no source in them e.g. "Recommended articles" may define one.
+type subjFormat struct {
+	lang           string
+	kind           AlertKind
+	prefix, suffix string
+	src            string
+}
+
+// subjFormats of all the supported locales.
+//
+// Most of the locales use "<source> - <type>" format, where a dash may be any of
+// unicode.Dash, so suffixes here are always normalized to " - ".
+var subjFormats = []subjFormat{
+	{lang: "en", kind: Citations, suffix: " - new citations"},
+	{lang: "en", kind: Citations, prefix: "New citations to my articles", src: "me"},
+	{lang: "en", kind: Articles, suffix: " - new articles"},
+	{lang: "en", kind: Related, suffix: " - new related research"},
+	{lang: "en", kind: Search, suffix: " - new results"},
+	{lang: "en", kind: Recommended, prefix: "Recommended articles"},
+
+	{lang: "fr", kind: Citations, suffix: " - nouvelles citations"},
+	{lang: "fr", kind: Citations, prefix: "Nouvelles citations de mes articles", src: "me"},
+	{lang: "fr", kind: Articles, suffix: " - nouveaux articles"},
+	{lang: "fr", kind: Related, suffix: " - nouvelles recherches associées"},
+	{lang: "fr", kind: Search, suffix: " - de nouveaux résultats sont disponibles"},
+	{lang: "fr", kind: Search, suffix: " - nouveaux résultats"},
+	{lang: "fr", kind: Recommended, prefix: "Articles recommandés"},
+
+	{lang: "ru", kind: Citations, suffix: ": новые ссылки"},
+	{lang: "ru", kind: Citations, prefix: "Новые ссылки на мои статьи", src: "me"},
+	{lang: "ru", kind: Articles, prefix: "Новые статьи пользователя "},
+	{lang: "ru", kind: Related, prefix: "Новые статьи, связанные с работами автора "},
+	{lang: "ru", kind: Search, prefix: "Новые результаты по запросу "},
+	{lang: "ru", kind: Recommended, prefix: "Рекомендуемые статьи"},
+
+	{lang: "de", kind: Citations, suffix: " - neue Zitationen"},
+	{lang: "de", kind: Citations, prefix: "Neue Zitationen meiner Artikel", src: "me"},
+	{lang: "de", kind: Articles, suffix: " - neue Artikel"},
+	{lang: "de", kind: Related, suffix: " - neue ähnliche Forschungsarbeiten"},
+	{lang: "de", kind: Search, suffix: " - neue Ergebnisse"},
+	{lang: "de", kind: Recommended, prefix: "Empfohlene Artikel"},
+
+	{lang: "es", kind: Citations, suffix: " - nuevas citas"},
+	{lang: "es", kind: Citations, prefix: "Nuevas citas de mis artículos", src: "me"},
+	{lang: "es", kind: Articles, suffix: " - artículos nuevos"},
+	{lang: "es", kind: Related, suffix: " - nuevas investigaciones relacionadas"},
+	{lang: "es", kind: Search, suffix: " - nuevos resultados"},
+	{lang: "es", kind: Recommended, prefix: "Artículos recomendados"},
+
+	{lang: "pt", kind: Citations, suffix: " - novas citações"},
+	{lang: "pt", kind: Citations, prefix: "Novas citações dos meus artigos", src: "me"},
+	{lang: "pt", kind: Articles, suffix: " - novos artigos"},
+	{lang: "pt", kind: Related, suffix: " - novas pesquisas relacionadas"},
+	{lang: "pt", kind: Search, suffix: " - novos resultados"},
+	{lang: "pt", kind: Recommended, prefix: "Artigos recomendados"},
+
+	{lang: "zh", kind: Citations, suffix: " - 新的引用"},
+	{lang: "zh", kind: Citations, prefix: "我的文章有新的引用", src: "me"},
+	{lang: "zh", kind: Articles, suffix: " - 新文章"},
+	{lang: "zh", kind: Related, suffix: " - 新的相关研究"},
+	{lang: "zh", kind: Search, suffix: " - 新的结果"},
+	{lang: "zh", kind: Recommended, prefix: "推荐的文章"},
+
+	{lang: "ja", kind: Citations, suffix: " - 新しい引用"},
+	{lang: "ja", kind: Citations, prefix: "自分の論文の新しい引用", src: "me"},
+	{lang: "ja", kind: Articles, suffix: " - 新しい論文"},
+	{lang: "ja", kind: Related, suffix: " - 新しい関連研究"},
+	{lang: "ja", kind: Search, suffix: " - 新しい結果"},
+	{lang: "ja", kind: Recommended, prefix: "おすすめの論文"},
+}
+
+// match returns the source of alert, if the subject is in this format.
+func (f subjFormat) match(subj string) (string, bool) {
+	if len(subj) < len(f.prefix)+len(f.suffix) ||
+		!strings.HasPrefix(subj, f.prefix) || !strings.HasSuffix(subj, f.suffix) {
+		return "", false
+	}
+	if f.src != "" {
+		return f.src, subj == f.prefix+f.suffix
+	}
+	return strings.TrimSpace(subj[len(f.prefix) : len(subj)-len(f.suffix)]), true
+}
+
+// NormalizeAndSplit normalizes subj format and split it to the source and the kind of alert.
+// Source is e.g. an author name, a paper title or a search query, and may be empty.
+//
+// The longest matching format from subjFormats wins. Subjects in an unknown locale,
+// but \w a dash-separated source, are of UnknownAlert kind.
+func NormalizeAndSplit(subj string) (string, AlertKind) {
+	subj = normalizeDashes(strings.TrimSpace(subj))
+
+	src, kind, longest := "", UnknownAlert, -1
+	for _, f := range subjFormats {
+		s, ok := f.match(subj)
+		if n := len(f.prefix) + len(f.suffix); ok && n > longest {
+			src, kind, longest = s, f.kind, n
+		}
+	}
+
+	if i := strings.LastIndex(subj, " - "); longest < 0 && i > 0 {
+		return subj[:i], UnknownAlert
+	}
+	return src, kind
+}
+
+// normalizeDashes replaces any of unicode.Dash, surrounded by spaces, by a "-".
+func normalizeDashes(s string) string {
+	var b strings.Builder
+	prevSpace := false
+	for i, r := range s {
+		if prevSpace && unicode.In(r, unicode.Dash) && strings.HasPrefix(s[i+utf8.RuneLen(r):], " ") {
+			r = '-'
+		}
+		b.WriteRune(r)
+		prevSpace = r == ' '
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query builds a Gmail search query, that is also understood by all the other sources.
+// The zero value matches all the messages.
+//
+//	q := Query{}.Label("scholar").NewerThan("7d")
+//	unread, read := q.Unread().String(), q.Read().String()
+type Query struct {
+	label, from string
+	after       time.Time
+	before      time.Time
+	newerThan   string
+	read        *bool
+}
+
+var newerThanRe = regexp.MustCompile(`^(\d+)([dmy])$`)
+
+// Label only matches messages under a given label, by name or ID.
+func (q Query) Label(label string) Query { q.label = label; return q }
+
+// From only matches messages from a given sender.
+func (q Query) From(from string) Query { q.from = from; return q }
+
+// After only matches messages received on or after a given day.
+func (q Query) After(t time.Time) Query { q.after = t; return q }
+
+// Before only matches messages received before a given day.
+func (q Query) Before(t time.Time) Query { q.before = t; return q }
+
+// NewerThan only matches messages newer than a given period: a number of
+// days, months or years e.g. "7d", "2m" or "1y". See ValidPeriod.
+func (q Query) NewerThan(period string) Query { q.newerThan = period; return q }
+
+// Unread only matches unread messages.
+func (q Query) Unread() Query { read := false; q.read = &read; return q }
+
+// Read only matches messages that have been read.
+func (q Query) Read() Query { read := true; q.read = &read; return q }
+
+// ValidPeriod returns an error if the period is not in a format, supported by NewerThan.
+func ValidPeriod(period string) error {
+	if !newerThanRe.MatchString(period) {
+		return fmt.Errorf("period %q must be a number of days, months or years e.g. 7d, 2m, 1y", period)
+	}
+	return nil
+}
+
+// String returns the query in Gmail search syntax.
+func (q Query) String() string {
+	var terms []string
+	add := func(key, value string) {
+		if strings.ContainsAny(value, " \t") {
+			value = strconv.Quote(value)
+		}
+		terms = append(terms, key+":"+value)
+	}
+
+	if q.label != "" {
+		add("label", q.label)
+	}
+	if q.from != "" {
+		add("from", q.from)
+	}
+	if !q.after.IsZero() {
+		add("after", q.after.Format(queryDate))
+	}
+	if !q.before.IsZero() {
+		add("before", q.before.Format(queryDate))
+	}
+	if q.newerThan != "" {
+		add("newer_than", q.newerThan)
+	}
+	if q.read != nil && *q.read {
+		add("is", "read")
+	} else if q.read != nil {
+		add("is", "unread")
+	}
+	return strings.Join(terms, " ")
+}
+
+// queryDate is the date format of Gmail search.
+const queryDate = "2006/01/02"
+
+// periodStart returns the start of a period, as accepted by NewerThan, ending now.
+func periodStart(period string, now time.Time) (time.Time, error) {
+	m := newerThanRe.FindStringSubmatch(period)
+	if m == nil {
+		return time.Time{}, ValidPeriod(period)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch m[2] {
+	case "d":
+		return now.AddDate(0, 0, -n), nil
+	case "m":
+		return now.AddDate(0, -n, 0), nil
+	default:
+		return now.AddDate(-n, 0, 0), nil
+	}
+}
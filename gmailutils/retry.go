@@ -0,0 +1,143 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Backoff is a policy of retrying failed Gmail API requests \w a jittered exponential backoff.
+type Backoff struct {
+	Retries int           // max number of retries, after the first attempt
+	Initial time.Duration // max delay before the first retry
+	Max     time.Duration // max delay between any two attempts
+}
+
+// DefaultBackoff is used by the Gmail source, unless configured otherwise.
+var DefaultBackoff = Backoff{Retries: 5, Initial: 500 * time.Millisecond, Max: 32 * time.Second}
+
+// delay returns a random ("full jitter") delay before the given retry attempt, starting from 0.
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Initial << uint(attempt)
+	if d <= 0 || d > b.Max { // overflow
+		d = b.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// Do calls op until it succeeds, fails \w a permanent error, runs out of retries
+// or the context is canceled. Returns the last error.
+func (b Backoff) Do(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		retry, after := isRetryable(err)
+		if !retry || attempt >= b.Retries {
+			return err
+		}
+
+		d := b.delay(attempt)
+		if after > d { // server knows better
+			d = after
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// rateLimitReasons are reasons of 403 errors, that are worth a retry,
+// as documented at https://developers.google.com/gmail/api/guides/handle-errors
+// Other quota errors, e.g. the daily limit, will not go away soon.
+var rateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// isRetryable returns true for rate-limit and server-side errors of Gmail API,
+// and a delay requested by the server through Retry-After, if any.
+func isRetryable(err error) (bool, time.Duration) {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false, 0
+	}
+
+	var after time.Duration
+	if secs, err := strconv.Atoi(apiErr.Header.Get("Retry-After")); err == nil {
+		after = time.Duration(secs) * time.Second
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= 500:
+		return true, after
+	case apiErr.Code == http.StatusForbidden:
+		for _, e := range apiErr.Errors {
+			if rateLimitReasons[e.Reason] {
+				return true, after
+			}
+		}
+	}
+	return false, 0
+}
+
+// FetchError reports the messages that failed to be fetched, even after retries.
+// Messages that were fetched successfully are still returned alongside it.
+type FetchError struct {
+	Errs map[string]error // by message ID
+}
+
+// IDs returns IDs of all the messages that failed, sorted.
+func (e *FetchError) IDs() []string {
+	ids := make([]string, 0, len(e.Errs))
+	for id := range e.Errs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (e *FetchError) Error() string {
+	ids := e.IDs()
+	if len(ids) == 0 {
+		return "failed to fetch 0 messages"
+	}
+	shown := ids
+	if len(shown) > 5 {
+		shown = shown[:5]
+	}
+	return fmt.Sprintf("failed to fetch %d messages (%s): %v",
+		len(ids), strings.Join(shown, ", "), e.Errs[ids[0]])
+}
@@ -0,0 +1,214 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeGmail is a stand-in for Gmail API, that fails the first requests for some messages.
+type fakeGmail struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	failures map[string][]int // message ID -> status codes of the first responses
+	reason   string           // of 403 errors
+	batches  int
+	noBatch  bool // fail all the batch requests
+	truncate bool // cut the batch responses off after the first part
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/gmail/v1/users/me/messages/"
+	if r.URL.Path == "/batch/gmail/v1" {
+		f.serveBatch(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+
+	f.mu.Lock()
+	n := f.calls[id]
+	f.calls[id]++
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if codes := f.failures[id]; n < len(codes) {
+		code := codes[n]
+		reason := "backendError"
+		if code == http.StatusForbidden {
+			reason = f.reason
+		} else if code == http.StatusNotFound {
+			reason = "notFound"
+		}
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"fake","errors":[{"reason":%q}]}}`, code, reason)
+		return
+	}
+	json.NewEncoder(w).Encode(&gmail.Message{Id: id, Snippet: "message " + id})
+}
+
+// serveBatch handles each part of a multipart/mixed request as a separate request.
+func (f *fakeGmail) serveBatch(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.batches++
+	f.mu.Unlock()
+	if f.noBatch {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"code":400,"message":"fake"}}`)
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// requests have no HTTP version, as in the docs of Gmail API
+		br := bufio.NewReader(part)
+		line, _ := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); !strings.Contains(line, " HTTP/") {
+			line += " HTTP/1.1"
+		}
+		req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(line+"\r\n"), br)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<response-" + strings.Trim(part.Header.Get("Content-Id"), "<>") + ">"},
+		})
+		fmt.Fprintf(pw, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n\r\n%s",
+			rec.Code, http.StatusText(rec.Code), rec.Body.String())
+
+		if f.truncate { // in the middle of the next part
+			pw, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/http"}})
+			fmt.Fprint(pw, "HTTP/1.1 200")
+			return
+		}
+	}
+	mw.Close()
+}
+
+func newFakeGmailSource(t *testing.T, f *fakeGmail) *GmailSource {
+	f.calls = map[string]int{}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	src, err := NewGmailSource(ts.Client(), "me", 2)
+	require.NoError(t, err)
+	src.srv.BasePath = ts.URL + "/gmail/v1/users/"
+	src.backoff = Backoff{Retries: 3, Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	src.batchSize = 1
+	return src
+}
+
+func TestFetchRetries(t *testing.T) {
+	f := &fakeGmail{
+		failures: map[string][]int{
+			"flaky":   {503, 500},
+			"limited": {429, 429, 429},
+			"quota":   {403},
+			"missing": {404, 404, 404, 404, 404},
+			"down":    {502, 502, 502, 502, 502},
+		},
+		reason: "rateLimitExceeded",
+	}
+	src := newFakeGmailSource(t, f)
+
+	ids := []string{"ok", "flaky", "limited", "quota", "missing", "down"}
+	msgs, err := src.Fetch(context.Background(), ids)
+
+	require.Error(t, err)
+	fe, ok := err.(*FetchError)
+	require.True(t, ok, "error must be a *FetchError, got %T", err)
+	assert.Equal(t, []string{"down", "missing"}, fe.IDs())
+
+	assert.Len(t, msgs, 4)
+	for _, m := range msgs {
+		assert.NotNil(t, m)
+	}
+
+	assert.Equal(t, 1, f.calls["missing"], "not found must not be retried")
+	assert.Equal(t, 4, f.calls["down"], "must retry up to Backoff.Retries times")
+	assert.Equal(t, 4, f.calls["limited"])
+}
+
+func TestFetchQuotaExceeded(t *testing.T) {
+	f := &fakeGmail{
+		failures: map[string][]int{"quota": {403}},
+		reason:   "dailyLimitExceeded",
+	}
+	src := newFakeGmailSource(t, f)
+
+	msgs, err := src.Fetch(context.Background(), []string{"ok", "quota"})
+	require.Error(t, err)
+	assert.Equal(t, []string{"quota"}, err.(*FetchError).IDs())
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, 1, f.calls["quota"], "daily quota errors must not be retried")
+}
+
+func TestBackoffCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := Backoff{Retries: 10, Initial: time.Hour, Max: time.Hour}
+
+	calls := 0
+	err := b.Do(ctx, func() error {
+		calls++
+		cancel()
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,144 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"google.golang.org/api/gmail/v1"
+)
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// ParseRFC822 reads a raw RFC 822 message and converts it to the same shape
+// as returned by Gmail API: decoded headers and a tree of MIME parts, where
+// every leaf part body is transfer-decoded, converted to UTF-8 and base64url encoded.
+//
+// Message ID is taken from the Message-Id header, if any.
+func ParseRFC822(r io.Reader) (*gmail.Message, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := parsePart(textproto.MIMEHeader(m.Header), m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &gmail.Message{
+		Id:      strings.Trim(m.Header.Get("Message-Id"), "<> "),
+		Payload: payload,
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.InternalDate = date.UnixNano() / 1e6
+	}
+	return msg, nil
+}
+
+func parsePart(header textproto.MIMEHeader, body io.Reader) (*gmail.MessagePart, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil { // RFC 2045 default
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+
+	part := &gmail.MessagePart{
+		MimeType: mediaType,
+		Headers:  decodeHeaders(header),
+		Body:     &gmail.MessagePartBody{},
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s part: %v", mediaType, err)
+			}
+
+			child, err := parsePart(p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := ioutil.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %v", mediaType, err)
+	}
+
+	if cs := params["charset"]; strings.HasPrefix(mediaType, "text/") && cs != "" {
+		utf8Reader, err := charset.NewReaderLabel(cs, strings.NewReader(string(data)))
+		if err == nil {
+			if utf8Data, err := ioutil.ReadAll(utf8Reader); err == nil {
+				data = utf8Data
+			}
+		}
+	}
+
+	part.Body.Data = base64.URLEncoding.EncodeToString(data)
+	part.Body.Size = int64(len(data))
+	return part, nil
+}
+
+// transferDecoder returns a reader, decoding body according to the Content-Transfer-Encoding.
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body) // ignores \r and \n
+	}
+	return body
+}
+
+// decodeHeaders returns all headers, sorted by name, with RFC 2047 encoded-words decoded.
+func decodeHeaders(header textproto.MIMEHeader) []*gmail.MessagePartHeader {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers []*gmail.MessagePartHeader
+	for _, name := range names {
+		for _, v := range header[name] {
+			if decoded, err := headerDecoder.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			headers = append(headers, &gmail.MessagePartHeader{Name: name, Value: v})
+		}
+	}
+	return headers
+}
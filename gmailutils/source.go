@@ -0,0 +1,543 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MessageSource is a backend that alert messages are read from: Gmail, fixtures, etc.
+//
+// Queries use a subset of Gmail search syntax, see parseQuery for the terms
+// that are supported by the non-Gmail implementations.
+type MessageSource interface {
+	// Labels lists all the labels (or folders) available.
+	Labels(ctx context.Context) ([]*gmail.Label, error)
+	// Search returns IDs of all the messages matching the query.
+	Search(ctx context.Context, query string) ([]string, error)
+	// Fetch returns full messages for the given IDs.
+	Fetch(ctx context.Context, ids []string) ([]*gmail.Message, error)
+	// Modify adds and removes label IDs to/from all the given messages.
+	Modify(ctx context.Context, ids []string, add, remove []string) error
+}
+
+// FetchMessages searches and fetches all messages matching the query from a given source.
+func FetchMessages(ctx context.Context, src MessageSource, query string) ([]*gmail.Message, error) {
+	ids, err := src.Search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return src.Fetch(ctx, ids)
+}
+
+// MessageIDs returns IDs of the given messages.
+func MessageIDs(msgs []*gmail.Message) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+// Unseen returns only the messages that were not seen yet e.g. under another label,
+// adding them to seen.
+func Unseen(msgs []*gmail.Message, seen map[string]bool) []*gmail.Message {
+	var res []*gmail.Message
+	for _, m := range msgs {
+		if !seen[m.Id] {
+			seen[m.Id] = true
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// GmailSource is a MessageSource backed by Gmail API.
+type GmailSource struct {
+	srv          *gmail.Service
+	client       *http.Client
+	user         string
+	concurentReq int
+	batchSize    int // messages per batch request, 1 disables batching
+	backoff      Backoff
+	cache        *Cache // optional
+
+	labelsMu sync.Mutex
+	labels   []*gmail.Label // to resolve label names, see labelID
+}
+
+// NewGmailSource returns a Gmail source for the given user, using authorized http Client.
+func NewGmailSource(client *http.Client, user string, concurentReq int) (*GmailSource, error) {
+	srv, err := gmail.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &GmailSource{
+		srv:          srv,
+		client:       client,
+		user:         user,
+		concurentReq: concurentReq,
+		batchSize:    DefaultBatchSize,
+		backoff:      DefaultBackoff,
+	}, nil
+}
+
+// Labels lists all Gmail labels of the user.
+func (g *GmailSource) Labels(ctx context.Context) ([]*gmail.Label, error) {
+	var labelsResp *gmail.ListLabelsResponse
+	err := g.backoff.Do(ctx, func() (err error) {
+		labelsResp, err = g.srv.Users.Labels.List(g.user).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return labelsResp.Labels, nil
+}
+
+// labelID resolves a label name to the ID, see FindLabel. Labels are only listed once,
+// unless there is no such label e.g. it was created since.
+func (g *GmailSource) labelID(ctx context.Context, name string) (string, error) {
+	g.labelsMu.Lock()
+	defer g.labelsMu.Unlock()
+
+	if l := FindLabel(g.labels, name); l != nil {
+		return l.Id, nil
+	}
+	labels, err := g.Labels(ctx)
+	if err != nil {
+		return "", err
+	}
+	g.labels = labels
+	if l := FindLabel(g.labels, name); l != nil {
+		return l.Id, nil
+	}
+	return "", fmt.Errorf("no label %q in Gmail", name)
+}
+
+// Search lists IDs of all messages matching a Gmail search query.
+// A label in the query is resolved to the ID, so any label name works, see FindLabel.
+func (g *GmailSource) Search(ctx context.Context, query string) ([]string, error) {
+	log.Printf("searching messages from Gmail: %q", query)
+	start := time.Now()
+
+	list := func() *gmail.UsersMessagesListCall { return g.srv.Users.Messages.List(g.user).Q(query) }
+	if label, rest := splitLabel(query); label != "" {
+		id, err := g.labelID(ctx, label)
+		if err != nil {
+			return nil, err
+		}
+		list = func() *gmail.UsersMessagesListCall {
+			return g.srv.Users.Messages.List(g.user).LabelIds(id).Q(rest)
+		}
+	}
+
+	var msgIDs []string
+	err := g.backoff.Do(ctx, func() error {
+		msgIDs = nil // start over
+		return list().Pages(ctx, func(mr *gmail.ListMessagesResponse) error {
+			for _, msg := range mr.Messages {
+				msgIDs = append(msgIDs, msg.Id)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Unable to list messages for query:%q - %v", query, err)
+		return nil, err
+	}
+
+	log.Printf("%d messages found (took %.0f sec)", len(msgIDs), time.Since(start).Seconds())
+	return msgIDs, nil
+}
+
+// Fetch fetches the given messages from Gmail, doing N concurrent batch requests.
+// Failed requests are retried, and the messages that still failed are reported by a *FetchError.
+func (g *GmailSource) Fetch(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	return collect(g.FetchAsync(ctx, ids))
+}
+
+// FetchAsync streams the given messages from Gmail in the same order, doing N concurrent requests.
+// See FetchAsync for details.
+func (g *GmailSource) FetchAsync(ctx context.Context, ids []string) (<-chan *gmail.Message, <-chan error) {
+	return g.fetchAsync(ctx, ids, g.cache)
+}
+
+// fetchAsync streams the given messages, looking them up in a cache first, if any.
+func (g *GmailSource) fetchAsync(ctx context.Context, ids []string, cache *Cache) (<-chan *gmail.Message, <-chan error) {
+	size, fetch := 1, single(g.get)
+	if g.batchSize > 1 {
+		size, fetch = g.batchSize, g.batchGet
+	}
+	if size > MaxBatchSize {
+		size = MaxBatchSize
+	}
+
+	if cache != nil {
+		if err := cache.Evict(); err != nil {
+			log.Printf("Unable to evict messages from cache: %v", err)
+		}
+		fetch = cache.cached(fetch)
+	}
+	return fetchBatchesAsync(ctx, ids, g.concurentReq, size, fetch)
+}
+
+// Account returns the email address of the user.
+func (g *GmailSource) Account(ctx context.Context) (string, error) {
+	profile, err := g.profile(ctx)
+	if err != nil {
+		return "", err
+	}
+	return profile.EmailAddress, nil
+}
+
+// profile returns the account, and it's current history ID.
+func (g *GmailSource) profile(ctx context.Context) (profile *gmail.Profile, err error) {
+	err = g.backoff.Do(ctx, func() error {
+		profile, err = g.srv.Users.GetProfile(g.user).Context(ctx).Do()
+		return err
+	})
+	return profile, err
+}
+
+// SetCache makes the source to look up messages in a given cache, before fetching them from Gmail.
+func (g *GmailSource) SetCache(c *Cache) {
+	g.cache = c
+}
+
+// get fetches a single message, retrying on rate-limit and server errors.
+func (g *GmailSource) get(ctx context.Context, id string) (msg *gmail.Message, err error) {
+	err = g.backoff.Do(ctx, func() error {
+		msg, err = g.srv.Users.Messages.Get(g.user, id).Context(ctx).Do()
+		return err
+	})
+	return msg, err
+}
+
+// Modify batch-modifies labels of the given messages, by label IDs,
+// in chunks of MaxModifyIDs messages.
+func (g *GmailSource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	for start := 0; start < len(ids); start += MaxModifyIDs {
+		end := start + MaxModifyIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err := g.backoff.Do(ctx, func() error {
+			return g.srv.Users.Messages.BatchModify(g.user, &gmail.BatchModifyMessagesRequest{
+				Ids:            ids[start:end],
+				AddLabelIds:    add,
+				RemoveLabelIds: remove,
+			}).Context(ctx).Do()
+		})
+		if err != nil {
+			return fmt.Errorf("messages %d-%d of %d: %w", start, end, len(ids), err)
+		}
+	}
+	return nil
+}
+
+// Trash moves the given messages to the trash, one request per message as there is no batch one.
+func (g *GmailSource) Trash(ctx context.Context, ids []string) error {
+	for i, id := range ids {
+		err := g.backoff.Do(ctx, func() error {
+			_, err := g.srv.Users.Messages.Trash(g.user, id).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("message %d of %d: %w", i, len(ids), err)
+		}
+	}
+	return nil
+}
+
+// CreateLabel creates a new user label, visible in Gmail.
+func (g *GmailSource) CreateLabel(ctx context.Context, name string) (label *gmail.Label, err error) {
+	err = g.backoff.Do(ctx, func() error {
+		label, err = g.srv.Users.Labels.Create(g.user, &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g.labelsMu.Lock()
+	g.labels = append(g.labels, label)
+	g.labelsMu.Unlock()
+	return label, nil
+}
+
+// MemorySource is a MessageSource that keeps all messages in memory.
+// It is safe for concurrent use.
+type MemorySource struct {
+	mu     sync.RWMutex
+	labels []*gmail.Label
+	msgs   []*gmail.Message // in search order
+}
+
+// NewMemorySource returns a source \w the given labels and messages.
+func NewMemorySource(labels []*gmail.Label, msgs []*gmail.Message) *MemorySource {
+	return &MemorySource{labels: labels, msgs: msgs}
+}
+
+// NewFixturesSource returns an in-memory source, populated from
+// the labels.json, unread.json and read.json files in a given directory.
+func NewFixturesSource(dir string) *MemorySource {
+	labels := ReadLblFixturesJSON(filepath.Join(dir, "labels.json"))
+	msgs := ReadMsgFixturesJSON(filepath.Join(dir, "unread.json"))
+	msgs = append(msgs, ReadMsgFixturesJSON(filepath.Join(dir, "read.json"))...)
+	return NewMemorySource(labels, msgs)
+}
+
+// Labels returns all the labels.
+func (m *MemorySource) Labels(ctx context.Context) ([]*gmail.Label, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.labels, nil
+}
+
+// Search returns IDs of the messages, matching the query.
+func (m *MemorySource) Search(ctx context.Context, query string) ([]string, error) {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ids []string
+	for _, msg := range m.msgs {
+		if q.matches(msg, m.labels) {
+			ids = append(ids, msg.Id)
+		}
+	}
+	return ids, nil
+}
+
+// Fetch returns the messages by IDs.
+func (m *MemorySource) Fetch(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msgs := make([]*gmail.Message, 0, len(ids))
+	for _, id := range ids {
+		msg := m.find(id)
+		if msg == nil {
+			return nil, fmt.Errorf("message %q not found", id)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Modify adds and removes labels IDs of the given messages.
+func (m *MemorySource) Modify(ctx context.Context, ids []string, add, remove []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		msg := m.find(id)
+		if msg == nil {
+			return fmt.Errorf("message %q not found", id)
+		}
+
+		var labelIds []string
+		for _, l := range msg.LabelIds {
+			if !contains(remove, l) && !contains(add, l) {
+				labelIds = append(labelIds, l)
+			}
+		}
+		msg.LabelIds = append(labelIds, add...)
+	}
+	return nil
+}
+
+// Trash replaces all the labels of the given messages by TRASH.
+func (m *MemorySource) Trash(ctx context.Context, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		msg := m.find(id)
+		if msg == nil {
+			return fmt.Errorf("message %q not found", id)
+		}
+		msg.LabelIds = []string{"TRASH"}
+	}
+	return nil
+}
+
+// CreateLabel adds a new user label.
+func (m *MemorySource) CreateLabel(ctx context.Context, name string) (*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	label := &gmail.Label{Id: fmt.Sprintf("Label_%d", len(m.labels)+1), Name: name, Type: "user"}
+	m.labels = append(m.labels, label)
+	return label, nil
+}
+
+func (m *MemorySource) find(id string) *gmail.Message {
+	for _, msg := range m.msgs {
+		if msg.Id == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// query is a parsed subset of a Gmail search query.
+type query struct {
+	label  string
+	from   string
+	read   *bool
+	after  time.Time
+	before time.Time
+}
+
+// parseQuery parses a Gmail search query, only supporting the terms
+// 'label:<name>', 'from:<sender>', 'is:read', 'is:unread', 'after:<date>',
+// 'before:<date>' and 'newer_than:<period>', as produced by Query.
+// Values \w spaces must be double-quoted, as in 'label:"Scholar alerts"'.
+func parseQuery(s string) (*query, error) {
+	q := &query{}
+	for _, term := range splitQuery(s) {
+		kv := strings.SplitN(term, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unsupported search term %q in %q", term, s)
+		}
+
+		switch k, v := kv[0], strings.Trim(kv[1], `"`); {
+		case k == "label":
+			q.label = v
+		case k == "from":
+			q.from = v
+		case k == "is" && (v == "read" || v == "unread"):
+			read := v == "read"
+			q.read = &read
+		case k == "after" || k == "before":
+			t, err := parseQueryDate(v)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported date in %q: %v", term, err)
+			}
+			if k == "after" {
+				q.after = t
+			} else {
+				q.before = t
+			}
+		case k == "newer_than":
+			t, err := periodStart(v, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			if t.After(q.after) {
+				q.after = t
+			}
+		default:
+			return nil, fmt.Errorf("unsupported search term %q in %q", term, s)
+		}
+	}
+	return q, nil
+}
+
+// parseQueryDate parses a date as "2006/01/02", "2006-01-02" or seconds since epoch.
+func parseQueryDate(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.ParseInLocation(queryDate, strings.ReplaceAll(s, "-", "/"), time.Local)
+}
+
+// splitLabel returns the label of a query, and the rest of it.
+func splitLabel(query string) (label, rest string) {
+	var terms []string
+	for _, term := range splitQuery(query) {
+		if v := strings.TrimPrefix(term, "label:"); v != term && label == "" {
+			label = strings.Trim(v, `"`)
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return label, strings.Join(terms, " ")
+}
+
+// splitQuery splits a query on spaces, except the ones inside double quotes.
+func splitQuery(s string) []string {
+	var (
+		terms  []string
+		term   strings.Builder
+		quoted bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+			continue
+		}
+		term.WriteRune(r)
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+// matches returns true if the message satisfies all the query terms.
+func (q *query) matches(msg *gmail.Message, labels []*gmail.Label) bool {
+	if q.read != nil && *q.read == contains(msg.LabelIds, "UNREAD") {
+		return false
+	}
+	if q.from != "" && !strings.Contains(Header(msg.Payload, "From"), q.from) {
+		return false
+	}
+	if !q.after.IsZero() || !q.before.IsZero() {
+		received := time.Unix(0, msg.InternalDate*int64(time.Millisecond))
+		if msg.InternalDate == 0 || received.Before(q.after) || (!q.before.IsZero() && !received.Before(q.before)) {
+			return false
+		}
+	}
+	if q.label != "" {
+		l := FindLabel(labels, q.label)
+		if l == nil || !contains(msg.LabelIds, l.Id) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
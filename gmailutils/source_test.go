@@ -0,0 +1,117 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gmailutils
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestFixturesSource(t *testing.T) {
+	ctx := context.Background()
+	src := NewFixturesSource("../fixtures")
+
+	labels, err := src.Labels(ctx)
+	require.NoError(t, err)
+	assert.NotEmpty(t, labels)
+
+	var queries = []struct {
+		query string
+		n     int
+	}{
+		{"", 4},
+		{"is:unread", 2},
+		{"label:[-oss-]-_ml-in-se is:read", 2},
+		{"label:_test-ML-in-SE from:scholaralerts-noreply", 4},
+		{"label:no-such-label", 0},
+	}
+	for _, q := range queries {
+		msgs, err := FetchMessages(ctx, src, q.query)
+		require.NoError(t, err, q.query)
+		assert.Len(t, msgs, q.n, q.query)
+	}
+
+	_, err = src.Search(ctx, "subject:test")
+	assert.Error(t, err)
+}
+
+func TestMemorySourceModify(t *testing.T) {
+	ctx := context.Background()
+	src := NewFixturesSource("../fixtures")
+
+	unread, err := FetchMessages(ctx, src, "is:unread")
+	require.NoError(t, err)
+	require.NotEmpty(t, unread)
+
+	err = src.Modify(ctx, MessageIDs(unread), []string{"STARRED"}, []string{"UNREAD"})
+	require.NoError(t, err)
+
+	ids, err := src.Search(ctx, "is:unread")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Contains(t, unread[0].LabelIds, "STARRED")
+
+	err = src.Modify(ctx, []string{"no-such-id"}, nil, []string{"UNREAD"})
+	assert.Error(t, err)
+}
+
+func TestQuery(t *testing.T) {
+	day := time.Date(2020, 3, 15, 0, 0, 0, 0, time.Local)
+	q := Query{}.Label("Scholar alerts").From("scholaralerts-noreply").After(day).Before(day.AddDate(0, 0, 7))
+	assert.Equal(t, `label:"Scholar alerts" from:scholaralerts-noreply after:2020/03/15 before:2020/03/22 is:unread`, q.Unread().String())
+	assert.Equal(t, "newer_than:7d is:read", Query{}.NewerThan("7d").Read().String())
+	assert.Equal(t, "", Query{}.String())
+
+	assert.NoError(t, ValidPeriod("2m"))
+	assert.Error(t, ValidPeriod("2w"))
+
+	msg := func(id string, received time.Time) *gmail.Message {
+		return &gmail.Message{Id: id, InternalDate: received.UnixNano() / int64(time.Millisecond)}
+	}
+	src := NewMemorySource(nil, []*gmail.Message{
+		msg("before", day.Add(-time.Hour)),
+		msg("first", day),
+		msg("last", day.AddDate(0, 0, 7).Add(-time.Second)),
+		msg("after", day.AddDate(0, 0, 7)),
+		msg("recent", time.Now().Add(-time.Hour)),
+		{Id: "no-date"},
+	})
+
+	var queries = []struct {
+		query string
+		ids   []string
+	}{
+		{q.Label("").From("").String(), []string{"first", "last"}},
+		{"after:2020-03-15", []string{"first", "last", "after", "recent"}},
+		{"before:" + strconv.FormatInt(day.Unix(), 10), []string{"before"}},
+		{Query{}.NewerThan("1d").String(), []string{"recent"}},
+	}
+	for _, c := range queries {
+		ids, err := src.Search(context.Background(), c.query)
+		require.NoError(t, err, c.query)
+		assert.Equal(t, c.ids, ids, c.query)
+	}
+
+	_, err := src.Search(context.Background(), "newer_than:1w")
+	assert.Error(t, err)
+}
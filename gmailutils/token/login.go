@@ -0,0 +1,131 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// LoginCookie is the name of the cookie that binds a login in progress to the browser.
+const LoginCookie = "login"
+
+// loginAge is for how long a user has to complete a login at the OAuth provider.
+const loginAge = 10 * time.Minute
+
+// ErrInvalidState is returned when the OAuth state of a redirect does not match
+// the login started by the same browser, e.g. for a forged or a replayed redirect.
+var ErrInvalidState = errors.New("invalid OAuth state")
+
+// sameState compares the state of a redirect to the expected one in constant time,
+// not to leak how much of it matches.
+func sameState(got, state string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(state)) == 1
+}
+
+// RandomString returns a new random URL-safe string, encoding n random bytes.
+func RandomString(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// NewVerifier returns a new PKCE code verifier, see RFC 7636.
+func NewVerifier() string {
+	return RandomString(32)
+}
+
+// ChallengeOptions returns the options of AuthCodeURL \w a PKCE code challenge for the verifier.
+func ChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	sum := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// VerifierOption returns the option of Exchange \w the PKCE code verifier.
+func VerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
+
+type loginData struct {
+	Verifier string
+	Expires  time.Time
+}
+
+// NewLogin starts a login of the browser and returns a random OAuth state and a PKCE code verifier for it.
+// Both are kept in a cookie, the verifier encrypted and bound to the state. See Login.
+func (s *Sessions) NewLogin(w http.ResponseWriter) (state, verifier string, err error) {
+	state, verifier = RandomString(24), NewVerifier()
+	expires := time.Now().Add(loginAge)
+	sealed, err := s.seal(state, &loginData{verifier, expires})
+	if err != nil {
+		return "", "", err
+	}
+	http.SetCookie(w, s.loginCookie(state+"."+base64.RawURLEncoding.EncodeToString(sealed), expires))
+	return state, verifier, nil
+}
+
+// Login completes the login of the browser on a redirect from the OAuth provider, validating its state,
+// and returns the PKCE code verifier of the login. The login cookie is cleared, so it can only be used once.
+func (s *Sessions) Login(w http.ResponseWriter, r *http.Request) (string, error) {
+	c, err := r.Cookie(LoginCookie)
+	if err != nil {
+		return "", ErrInvalidState
+	}
+	del := s.loginCookie("", time.Unix(0, 0))
+	del.MaxAge = -1
+	http.SetCookie(w, del)
+
+	i := strings.Index(c.Value, ".")
+	if i < 0 {
+		return "", ErrInvalidState
+	}
+	state := c.Value[:i]
+	if state == "" || !sameState(r.FormValue("state"), state) {
+		return "", ErrInvalidState
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(c.Value[i+1:])
+	if err != nil {
+		return "", ErrInvalidState
+	}
+
+	data := &loginData{}
+	if err := s.open(state, sealed, data); err != nil || time.Now().After(data.Expires) {
+		return "", ErrInvalidState
+	}
+	return data.Verifier, nil
+}
+
+func (s *Sessions) loginCookie(value string, expires time.Time) *http.Cookie {
+	c := s.cookie(value, expires)
+	c.Name = LoginCookie
+	c.Path = "/login"
+	return c
+}
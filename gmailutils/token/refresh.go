@@ -0,0 +1,93 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// ReauthError is returned when a token has expired and can not be refreshed any more,
+// e.g. it has no refresh token or the access was revoked, so the user has to authorize again.
+type ReauthError struct {
+	Err error
+}
+
+func (e *ReauthError) Error() string {
+	return "authorization has expired, please log in again: " + e.Err.Error()
+}
+
+func (e *ReauthError) Unwrap() error { return e.Err }
+
+// IsReauth returns true if the error, or any error it wraps, is a ReauthError.
+func IsReauth(err error) bool {
+	var re *ReauthError
+	return errors.As(err, &re)
+}
+
+// savingSource refreshes tokens by a base source, and saves each new one.
+type savingSource struct {
+	src     oauth2.TokenSource
+	save    func(*oauth2.Token) error
+	refresh bool // the token has a refresh token
+
+	mu   sync.Mutex
+	last string // access token, saved last
+}
+
+// NewSavingSource returns a TokenSource that gets tokens from a base source, e.g. refreshing
+// them by oauth2.Config.TokenSource, and saves every new token by a given func, if any.
+// Errors of a refresh that the user has to authorize again for are *ReauthError.
+func NewSavingSource(src oauth2.TokenSource, tok *oauth2.Token, save func(*oauth2.Token) error) oauth2.TokenSource {
+	return &savingSource{src: src, save: save, refresh: tok.RefreshToken != "", last: tok.AccessToken}
+}
+
+func (s *savingSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		if !s.refresh || isPermanent(err) { // \wo a refresh token, only an expired one fails
+			return nil, &ReauthError{err}
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last && s.save != nil {
+		if err := s.save(tok); err != nil { // the token still works, until it expires
+			log.Printf("Unable to save the refreshed token: %v", err)
+		} else {
+			s.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+// isPermanent returns true for the errors of a refresh that would never succeed,
+// e.g. "invalid_grant" for a revoked token.
+func isPermanent(err error) bool {
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) || re.Response == nil {
+		return false
+	}
+	code := re.Response.StatusCode
+	return code == http.StatusBadRequest || code == http.StatusUnauthorized
+}
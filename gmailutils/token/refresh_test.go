@@ -0,0 +1,89 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type fakeTokenSource struct {
+	toks []*oauth2.Token
+	err  error
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	tok := f.toks[0]
+	if len(f.toks) > 1 {
+		f.toks = f.toks[1:]
+	}
+	return tok, nil
+}
+
+func TestSavingSource(t *testing.T) {
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh"}
+	refreshed := &oauth2.Token{AccessToken: "new", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+
+	var saved []string
+	save := func(tok *oauth2.Token) error {
+		saved = append(saved, tok.AccessToken)
+		return nil
+	}
+	ts := NewSavingSource(&fakeTokenSource{toks: []*oauth2.Token{old, refreshed}}, old, save)
+	for i := 0; i < 3; i++ {
+		_, err := ts.Token()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"new"}, saved, "only a refreshed token is saved, once")
+
+	for _, tc := range []struct {
+		err    error
+		reauth bool
+	}{
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}, true},
+		{fmt.Errorf("wrapped: %w", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}), true},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}, false},
+		{errors.New("connection refused"), false},
+	} {
+		ts := NewSavingSource(&fakeTokenSource{err: tc.err}, old, save)
+		_, err := ts.Token()
+		assert.Error(t, err)
+		assert.Equal(t, tc.reauth, IsReauth(err), "%v", tc.err)
+
+		// as returned by http.Client
+		err = &url.Error{Op: "Get", URL: "https://gmail.googleapis.com", Err: err}
+		assert.Equal(t, tc.reauth, IsReauth(err), "%v", tc.err)
+	}
+	assert.False(t, IsReauth(nil))
+
+	// an expired token \wo a refresh one, as by oauth2.Config.TokenSource
+	expired := &oauth2.Token{AccessToken: "old", Expiry: time.Now().Add(-time.Minute)}
+	_, err := NewSavingSource((&oauth2.Config{}).TokenSource(context.Background(), expired), expired, save).Token()
+	assert.True(t, IsReauth(err), "%v", err)
+}
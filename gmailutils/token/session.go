@@ -0,0 +1,358 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// SessionCookie is the name of the cookie \w a session ID.
+const SessionCookie = "session"
+
+// DefaultSessionAge is for how long a session is kept, since the login.
+const DefaultSessionAge = 30 * 24 * time.Hour
+
+// CSRFHeader is a header of the CSRF token, that requests changing a session must have,
+// or else a "csrf" form field. See Sessions.CSRFToken.
+const CSRFHeader = "X-CSRF-Token"
+
+// ErrNoSession is returned for requests \wo a valid session.
+var ErrNoSession = errors.New("no valid session")
+
+// ErrInvalidCSRF is returned for requests \wo the CSRF token of their session.
+var ErrInvalidCSRF = errors.New("invalid CSRF token")
+
+// Sessions is a server-side store of OAuth tokens, so that browsers only get
+// an opaque session ID in a cookie, signed to reject forged IDs early.
+//
+// Tokens are kept encrypted by AES-GCM, in memory and optionally in a directory,
+// a file per session, to survive restarts. Expired sessions are removed on each new one.
+type Sessions struct {
+	Secure bool          // cookies are only sent over HTTPS, true by default
+	MaxAge time.Duration // of a session, DefaultSessionAge by default
+
+	dir    string
+	aead   cipher.AEAD
+	macKey []byte
+
+	mu sync.Mutex
+	m  map[string]sealedSession // by session ID
+}
+
+type sealedSession struct {
+	data    []byte // encrypted sessionData
+	expires time.Time
+}
+
+type sessionData struct {
+	Token   *oauth2.Token
+	Expires time.Time
+}
+
+// NewSessions returns a session store, deriving the encryption and signing keys from
+// a given secret. Sessions are only kept in memory if dir is empty.
+func NewSessions(secret []byte, dir string) (*Sessions, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("session secret must be at least 16 bytes long")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create sessions directory %s: %v", dir, err)
+		}
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{
+		Secure: true,
+		MaxAge: DefaultSessionAge,
+		dir:    dir,
+		aead:   aead,
+		macKey: deriveKey(secret, "signing"),
+		m:      map[string]sealedSession{},
+	}, nil
+}
+
+// RandomSecret returns a new random secret, for sessions that do not need to outlive the process.
+func RandomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return secret
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// New starts a new session \w a given token, and sets the session cookie.
+func (s *Sessions) New(w http.ResponseWriter, tok *oauth2.Token) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	if err := s.prune(now); err != nil {
+		log.Printf("Unable to remove expired sessions: %v", err)
+	}
+	expires := now.Add(s.MaxAge)
+	if err := s.save(id, &sessionData{tok, expires}); err != nil {
+		return "", err
+	}
+	http.SetCookie(w, s.cookie(id+"."+s.sign(id), expires))
+	return id, nil
+}
+
+// Save replaces the token of an existing session e.g. after it was refreshed.
+func (s *Sessions) Save(id string, tok *oauth2.Token) error {
+	data, err := s.load(id)
+	if err != nil {
+		return err
+	}
+	data.Token = tok
+	return s.save(id, data)
+}
+
+// Get returns the session ID and the token of a request, if it has a valid session.
+func (s *Sessions) Get(r *http.Request) (string, *oauth2.Token, error) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", nil, ErrNoSession
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 {
+		return "", nil, ErrNoSession
+	}
+	id, sig := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(id))) {
+		return "", nil, ErrNoSession
+	}
+
+	data, err := s.load(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if time.Now().After(data.Expires) {
+		s.remove(id)
+		return "", nil, ErrNoSession
+	}
+	return id, data.Token, nil
+}
+
+// Delete ends the session of a request, if any, and clears the session cookie.
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) {
+	if id, _, err := s.Get(r); err == nil {
+		s.remove(id)
+	}
+	c := s.cookie("", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// NewContext returns a context \w the token of the request session set, if any. See FromContext.
+func (s *Sessions) NewContext(r *http.Request) context.Context {
+	id, tok, err := s.Get(r)
+	if err != nil {
+		return r.Context()
+	}
+	ctx := context.WithValue(r.Context(), sessionIDKey, id)
+	return context.WithValue(ctx, sessionKey, tok)
+}
+
+// CSRFToken returns a token for the forms of a session, that other sites can not read.
+func (s *Sessions) CSRFToken(id string) string {
+	return s.sign("csrf." + id)
+}
+
+// CheckCSRF returns ErrInvalidCSRF, unless the request has the CSRF token of the session
+// in the CSRFHeader or in a "csrf" form field.
+func (s *Sessions) CheckCSRF(r *http.Request, id string) error {
+	t := r.Header.Get(CSRFHeader)
+	if t == "" {
+		t = r.PostFormValue("csrf")
+	}
+	if t == "" || !hmac.Equal([]byte(t), []byte(s.CSRFToken(id))) {
+		return ErrInvalidCSRF
+	}
+	return nil
+}
+
+// SessionIDFromContext returns the session ID, set by Sessions.NewContext, if any.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(sessionIDKey).(string)
+	return id, ok
+}
+
+func (s *Sessions) cookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.Secure,
+		SameSite: http.SameSiteLaxMode, // sent on the redirect back from the OAuth provider
+	}
+}
+
+func (s *Sessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// path returns a file of the session, named by a hash so the IDs can not be read from the disk.
+func (s *Sessions) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *Sessions) save(id string, data *sessionData) error {
+	sealed, err := s.seal(id, data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[id] = sealedSession{sealed, data.Expires}
+	if s.dir == "" {
+		return nil
+	}
+	tmp := s.path(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(id))
+}
+
+func (s *Sessions) load(id string) (*sessionData, error) {
+	s.mu.Lock()
+	sess, ok := s.m[id]
+	s.mu.Unlock()
+	sealed := sess.data
+	if !ok && s.dir != "" {
+		var err error
+		if sealed, err = ioutil.ReadFile(s.path(id)); err != nil {
+			return nil, ErrNoSession
+		}
+	} else if !ok {
+		return nil, ErrNoSession
+	}
+
+	data := &sessionData{}
+	if err := s.open(id, sealed, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *Sessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, id)
+	if s.dir != "" {
+		os.Remove(s.path(id))
+	}
+}
+
+// prune removes all the expired sessions. The files can not be decrypted \wo the session IDs,
+// so the ones not written for longer than MaxAge are removed, as their sessions expired for sure.
+func (s *Sessions) prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.m {
+		if now.After(sess.expires) {
+			delete(s.m, id)
+		}
+	}
+	if s.dir == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if len(f.Name()) != 2*sha256.Size || !now.After(f.ModTime().Add(s.MaxAge)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal encrypts v as JSON, bound to a given ID e.g. a session ID.
+func (s *Sessions) seal(id string, v interface{}) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plain, []byte(id)), nil
+}
+
+// open decrypts v, sealed \w a given ID.
+func (s *Sessions) open(id string, sealed []byte, v interface{}) error {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return ErrNoSession
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(id))
+	if err != nil { // e.g. the secret has changed
+		return ErrNoSession
+	}
+	return json.Unmarshal(plain, v)
+}
@@ -0,0 +1,176 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// requestWith returns a request \w the cookies, set by a response.
+func requestWith(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	s, err := NewSessions(secret, dir)
+	require.NoError(t, err)
+
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+	w := httptest.NewRecorder()
+	id, err := s.New(w, tok)
+	require.NoError(t, err)
+
+	c := w.Result().Cookies()[0]
+	assert.True(t, c.Secure)
+	assert.True(t, c.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	assert.NotContains(t, c.Value, "refresh")
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := ioutil.ReadFile(dir + "/" + files[0].Name())
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "refresh", "tokens must be encrypted")
+	assert.NotContains(t, files[0].Name(), id)
+
+	r := requestWith(w)
+	gotID, got, err := s.Get(r)
+	require.NoError(t, err)
+	assert.Equal(t, id, gotID)
+	assert.Equal(t, "refresh", got.RefreshToken)
+
+	ctxTok, ok := FromContext(s.NewContext(r))
+	assert.True(t, ok)
+	assert.Equal(t, "access", ctxTok.AccessToken)
+
+	// survives a restart
+	s2, err := NewSessions(secret, dir)
+	require.NoError(t, err)
+	_, got, err = s2.Get(r)
+	require.NoError(t, err)
+	assert.Equal(t, "access", got.AccessToken)
+
+	require.NoError(t, s.Save(id, &oauth2.Token{AccessToken: "refreshed"}))
+	_, got, err = s.Get(r)
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed", got.AccessToken)
+
+	// forged and expired sessions
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.AddCookie(&http.Cookie{Name: SessionCookie, Value: id + ".forged"})
+	_, _, err = s.Get(forged)
+	assert.Equal(t, ErrNoSession, err)
+
+	other, err := NewSessions([]byte(strings.Repeat("x", 32)), dir)
+	require.NoError(t, err)
+	_, _, err = other.Get(r)
+	assert.Equal(t, ErrNoSession, err, "sessions signed with another secret")
+
+	s.MaxAge = -time.Second
+	w = httptest.NewRecorder()
+	_, err = s.New(w, tok)
+	require.NoError(t, err)
+	_, _, err = s.Get(requestWith(w))
+	assert.Equal(t, ErrNoSession, err)
+
+	// logout
+	w = httptest.NewRecorder()
+	s.Delete(w, r)
+	_, _, err = s.Get(r)
+	assert.Equal(t, ErrNoSession, err)
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+}
+
+func TestSessionsCSRF(t *testing.T) {
+	s, err := NewSessions(RandomSecret(), "")
+	require.NoError(t, err)
+	other, err := NewSessions(RandomSecret(), "")
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("csrf="+s.CSRFToken("id")))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.NoError(t, s.CheckCSRF(r, "id"))
+	assert.Equal(t, ErrInvalidCSRF, s.CheckCSRF(r, "another-id"))
+
+	r = httptest.NewRequest("POST", "/", nil)
+	assert.Equal(t, ErrInvalidCSRF, s.CheckCSRF(r, "id"))
+	r.Header.Set(CSRFHeader, other.CSRFToken("id"))
+	assert.Equal(t, ErrInvalidCSRF, s.CheckCSRF(r, "id"))
+	r.Header.Set(CSRFHeader, s.CSRFToken("id"))
+	assert.NoError(t, s.CheckCSRF(r, "id"))
+}
+
+func TestSessionsPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewSessions(RandomSecret(), dir)
+	require.NoError(t, err)
+	s.MaxAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+
+	tok := &oauth2.Token{AccessToken: "access"}
+	w := httptest.NewRecorder()
+	expired, err := s.New(w, tok)
+	require.NoError(t, err)
+	s.m[expired] = sealedSession{s.m[expired].data, old.Add(s.MaxAge)}
+	require.NoError(t, os.Chtimes(s.path(expired), old, old))
+
+	fresh, err := s.New(httptest.NewRecorder(), tok)
+	require.NoError(t, err)
+	assert.Len(t, s.m, 1, "expired sessions are removed from memory")
+	assert.Contains(t, s.m, fresh)
+	_, _, err = s.Get(requestWith(w))
+	assert.Equal(t, ErrNoSession, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "and from the directory")
+
+	// sessions of a previous run are only on the disk
+	require.NoError(t, os.Chtimes(s.path(fresh), old, old))
+	s, err = NewSessions(RandomSecret(), dir)
+	require.NoError(t, err)
+	s.MaxAge = time.Hour
+	_, err = s.New(httptest.NewRecorder(), tok)
+	require.NoError(t, err)
+
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,172 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// EncryptedExt is the extension of the files of tokens, encrypted by a passphrase.
+const EncryptedExt = ".enc"
+
+// encMagic starts each encrypted token file, \w a version of the format.
+var encMagic = []byte("sad-token-v1\n")
+
+// scrypt parameters, as recommended for interactive logins
+const (
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	scryptSalt = 16
+)
+
+// FileStore keeps tokens in the files of a directory, by name e.g. "token.json".
+//
+// With a passphrase the tokens are encrypted by AES-GCM \w a key, derived from it by scrypt,
+// so they can be kept anywhere and used \wo any user interaction e.g. from cron.
+type FileStore struct {
+	dir        string
+	passphrase []byte
+}
+
+// NewFileStore returns a store of tokens in a directory, encrypted if the passphrase is not empty.
+func NewFileStore(dir, passphrase string) *FileStore {
+	return &FileStore{dir: dir, passphrase: []byte(passphrase)}
+}
+
+// Path returns the path of the file that a token is saved to.
+func (s *FileStore) Path(name string) string {
+	path := filepath.Join(s.dir, name)
+	if len(s.passphrase) != 0 {
+		path += EncryptedExt
+	}
+	return path
+}
+
+// Load reads a token. A plain text token gets encrypted on the first load \w a passphrase.
+func (s *FileStore) Load(name string) (*oauth2.Token, error) {
+	plain := filepath.Join(s.dir, name)
+	if len(s.passphrase) == 0 {
+		tok, err := FromFile(plain)
+		if _, encErr := os.Stat(plain + EncryptedExt); os.IsNotExist(err) && encErr == nil {
+			return nil, fmt.Errorf("%s is encrypted, a passphrase is required", plain+EncryptedExt)
+		}
+		return tok, err
+	}
+
+	data, err := ioutil.ReadFile(plain + EncryptedExt)
+	if os.IsNotExist(err) {
+		return s.encrypt(name)
+	} else if err != nil {
+		return nil, err
+	}
+	return s.decrypt(plain+EncryptedExt, data)
+}
+
+// Save replaces a token, atomically.
+func (s *FileStore) Save(name string, tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if len(s.passphrase) != 0 {
+		if data, err = s.seal(data); err != nil {
+			return err
+		}
+	}
+	return writeFile(s.Path(name), data)
+}
+
+// encrypt replaces a plain text token by an encrypted one.
+func (s *FileStore) encrypt(name string) (*oauth2.Token, error) {
+	plain := filepath.Join(s.dir, name)
+	tok, err := FromFile(plain)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Save(name, tok); err != nil {
+		return nil, err
+	}
+	log.Printf("Encrypted the token %s to %s", plain, s.Path(name))
+	return tok, os.Remove(plain)
+}
+
+func (s *FileStore) seal(plain []byte) ([]byte, error) {
+	salt := make([]byte, scryptSalt)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(append(append([]byte{}, encMagic...), salt...), nonce...)
+	return aead.Seal(out, nonce, plain, encMagic), nil
+}
+
+func (s *FileStore) decrypt(path string, data []byte) (*oauth2.Token, error) {
+	if !bytes.HasPrefix(data, encMagic) || len(data) < len(encMagic)+scryptSalt {
+		return nil, fmt.Errorf("%s is not an encrypted token", path)
+	}
+	data = data[len(encMagic):]
+	aead, err := s.cipher(data[:scryptSalt])
+	if err != nil {
+		return nil, err
+	}
+	data = data[scryptSalt:]
+
+	n := aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("%s is not an encrypted token", path)
+	}
+	plain, err := aead.Open(nil, data[:n], data[n:], encMagic)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s, wrong passphrase?", path)
+	}
+	tok := &oauth2.Token{}
+	return tok, json.Unmarshal(plain, tok)
+}
+
+func (s *FileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+	plain := NewFileStore(dir, "")
+	_, err = plain.Load("token.json")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	require.NoError(t, plain.Save("token.json", tok))
+	got, err := plain.Load("token.json")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", got.RefreshToken)
+
+	// a plain text token gets encrypted on the first load
+	enc := NewFileStore(dir, "secret passphrase")
+	got, err = enc.Load("token.json")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", got.RefreshToken)
+	assert.Equal(t, filepath.Join(dir, "token.json"+EncryptedExt), enc.Path("token.json"))
+	_, err = os.Stat(filepath.Join(dir, "token.json"))
+	assert.True(t, os.IsNotExist(err), "plain text token is removed")
+
+	data, err := ioutil.ReadFile(enc.Path("token.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "refresh")
+
+	tok.AccessToken = "refreshed"
+	require.NoError(t, enc.Save("token.json", tok))
+	got, err = enc.Load("token.json")
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed", got.AccessToken)
+
+	_, err = NewFileStore(dir, "wrong passphrase").Load("token.json")
+	assert.Error(t, err)
+	_, err = plain.Load("token.json")
+	assert.Error(t, err)
+	assert.False(t, os.IsNotExist(err), "an encrypted token is not missing")
+}
@@ -19,11 +19,11 @@
 package token
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -35,21 +35,22 @@ import (
 )
 
 // FromWeb request a token from the web, then returns the retrieved token.
+// The code is captured by a redirect to a local server, see FromLoopback, or in headless
+// environments the device flow is used, see FromDevice, falling back to pasting the code.
 func FromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Fprintf(os.Stderr, "Open this link in the browser, then past the "+
-		"authorization code: \n%v\n", authURL)
-
-	_ = openURL(authURL) // ignore error as manual instuctions already provided
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	ctx := context.Background()
+	if !headless() {
+		tok, err := FromLoopback(ctx, config, openURL)
+		if err != nil {
+			log.Fatalf("Unable to retrieve token from web: %v", err)
+		}
+		return tok
 	}
 
-	tok, err := config.Exchange(context.Background(), authCode)
+	tok, err := FromDevice(ctx, config, GoogleDeviceAuthURL)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		log.Printf("%v, falling back to pasting the authorization code", err)
+		return fromPaste(ctx, config)
 	}
 	return tok
 }
@@ -63,7 +64,7 @@ func openURL(url string) error {
 	case "linux":
 		err = exec.Command("xdg-open", url).Start()
 	case "windows":
-		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", "http://localhost:4001/").Start()
+		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
 	case "darwin":
 		err = exec.Command("open", url).Start()
 	default:
@@ -84,73 +85,47 @@ func FromFile(file string) (*oauth2.Token, error) {
 	return tok, err
 }
 
-// TODO(bzz): move to session.go, cookies/context are together due to sharing the Key
 // contextKey is unexported type to prevent collisions with context keys.
 type contextKey string
 
 const (
-	sessionKey contextKey = "token"
-	labelKey   contextKey = "label"
+	sessionKey   contextKey = "token"
+	sessionIDKey contextKey = "session"
+	labelKey     contextKey = "label"
 )
 
-// FromContext returnes the token, saved from the cookies, if any.
+// FromContext returnes the token of the session, set by Sessions.NewContext, if any.
 func FromContext(ctx context.Context) (*oauth2.Token, bool) {
-	token := ctx.Value(sessionKey)
-	if token == nil { // not authorized
-		return nil, false
-	}
-
-	var tok oauth2.Token
-	tokenStr := token.(string)
-	err := json.NewDecoder(strings.NewReader(tokenStr)).Decode(&tok)
-	if err != nil {
-		log.Printf("Unable to decode JSON cookie k:%s v:%s, %v", sessionKey, tokenStr, err)
-		return nil, true
-	}
-	return &tok, true
+	tok, ok := ctx.Value(sessionKey).(*oauth2.Token)
+	return tok, ok
 }
 
-// LabelFromContext returnes the label, saved from the cookies, if any.
-func LabelFromContext(ctx context.Context) (string, bool) {
+// LabelsFromContext returnes the labels, saved from the cookies, if any.
+func LabelsFromContext(ctx context.Context) ([]string, bool) {
 	l := ctx.Value(labelKey)
-	if l == nil {
-		return "", false
+	if l == nil || l.(string) == "" {
+		return nil, false
 	}
 
-	return l.(string), true
+	return strings.Split(l.(string), labelsSep), true
 }
 
-// NewSessionCookie returns a new cookie with the token set.
-func NewSessionCookie(token *oauth2.Token) *http.Cookie {
-	var buf bytes.Buffer
-	json.NewEncoder(&buf).Encode(token) // FIXME(bzz): handle JSON encoding failures
-	sessionVal := base64.StdEncoding.EncodeToString(buf.Bytes())
-
-	return &http.Cookie{
-		Name:     string(sessionKey),
-		Value:    sessionVal,
-		Path:     "/",
-		Expires:  token.Expiry,
-		HttpOnly: true,
-	}
-}
+// labelsSep separates several labels in a cookie, as label names can not contain it.
+const labelsSep = "\n"
 
-// NewLabelCookie returns a new cookie with the token set.
-func NewLabelCookie(label string) *http.Cookie {
-	labelVal := base64.StdEncoding.EncodeToString([]byte(label))
+// NewLabelCookie returns a new cookie with the labels set.
+func NewLabelCookie(labels ...string) *http.Cookie {
+	labelVal := base64.StdEncoding.EncodeToString([]byte(strings.Join(labels, labelsSep)))
 
 	return &http.Cookie{
-		Name:  string(labelKey),
-		Value: labelVal,
-		Path:  "/",
+		Name:     string(labelKey),
+		Value:    labelVal,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-// NewSessionContext reads session cookie, returnes context with the token set to it, if any.
-func NewSessionContext(parent context.Context, cookies []*http.Cookie) context.Context {
-	return newContextWith(parent, cookies, sessionKey)
-}
-
 // NewLabelContext reads label cookie, returnes context with the label set to it, if any.
 func NewLabelContext(parent context.Context, cookies []*http.Cookie) context.Context {
 	return newContextWith(parent, cookies, labelKey)
@@ -180,10 +155,26 @@ func newContextWith(parent context.Context, cookies []*http.Cookie, key contextK
 // Save saves the token to a file path.
 func Save(path string, token *oauth2.Token) {
 	log.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
+	if err := WriteFile(path, token); err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+}
+
+// WriteFile replaces the token in a file path, atomically, so it is never left
+// half-written e.g. when the token is refreshed in the middle of a run.
+func WriteFile(path string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces a file \w the data, readable by the owner only.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
@@ -0,0 +1,248 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// GoogleDeviceAuthURL is the endpoint of the device authorization flow of Google, see FromDevice.
+const GoogleDeviceAuthURL = "https://oauth2.googleapis.com/device/code"
+
+// loginTimeout is for how long the CLI waits for the user to authorize in the browser.
+const loginTimeout = 5 * time.Minute
+
+// FromLoopback requests a token from the web, redirecting back to a temporary server on the
+// loopback interface, so the code is captured automatically. The auth URL is passed to open,
+// e.g. to open it in the browser.
+//
+// Redirects \w any other state are rejected, and the code is exchanged \w a PKCE verifier.
+func FromLoopback(ctx context.Context, config *oauth2.Config, open func(url string) error) (*oauth2.Token, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", l.Addr())
+	state, verifier := RandomString(24), NewVerifier()
+
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameState(r.FormValue("state"), state) { // e.g. a stale or a forged redirect, keep waiting
+			http.Error(w, ErrInvalidState.Error(), http.StatusBadRequest)
+			return
+		}
+		res := result{code: r.FormValue("code")}
+		if e := r.FormValue("error"); e != "" || res.code == "" {
+			res.err = fmt.Errorf("authorization failed: %q", e+r.FormValue("error_description"))
+			http.Error(w, res.err.Error(), http.StatusForbidden)
+		} else {
+			w.Write([]byte("Authorized, you can close this window and return to the terminal.\n"))
+		}
+		select {
+		case done <- res:
+		default: // already done
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	authURL := cfg.AuthCodeURL(state, append(ChallengeOptions(verifier), oauth2.AccessTypeOffline)...)
+	fmt.Fprintf(os.Stderr, "Open this link in the browser to authorize the access to Gmail:\n%v\n", authURL)
+	_ = open(authURL) // ignore error as manual instuctions already provided
+
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no authorization in %v: %v", loginTimeout, ctx.Err())
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return cfg.Exchange(ctx, res.code, VerifierOption(verifier))
+	}
+}
+
+// devicePollUnit is the unit of the polling interval of the device flow, shortened by tests.
+var devicePollUnit = time.Second
+
+// FromDevice requests a token by the device authorization flow (RFC 8628) for headless environments:
+// the user enters a code shown in the terminal at a URL, on any other device \w a browser.
+//
+// Google only supports it for "TVs and Limited Input devices" OAuth clients and a limited set of scopes,
+// so any error of the provider is returned right away, to fall back to another flow.
+func FromDevice(ctx context.Context, config *oauth2.Config, deviceAuthURL string) (*oauth2.Token, error) {
+	var auth struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		VerificationURL string `json:"verification_url"` // as Google calls it
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	err := postForm(ctx, deviceAuthURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	}, &auth)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization failed: %v", err)
+	}
+	if auth.VerificationURI == "" {
+		auth.VerificationURI = auth.VerificationURL
+	}
+	if auth.Interval <= 0 { // defaults of RFC 8628
+		auth.Interval = 5
+	}
+	if auth.ExpiresIn <= 0 {
+		auth.ExpiresIn = 1800
+	}
+	fmt.Fprintf(os.Stderr, "Open %s in a browser on any device and enter the code: %s\n",
+		auth.VerificationURI, auth.UserCode)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(auth.ExpiresIn)*time.Second)
+	defer cancel()
+	interval := time.Duration(auth.Interval) * devicePollUnit
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("the device code has expired: %v", ctx.Err())
+		case <-time.After(interval):
+		}
+
+		var tok struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		err := postForm(ctx, config.Endpoint.TokenURL, url.Values{
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+			"device_code":   {auth.DeviceCode},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &tok)
+		switch e, _ := err.(*oauthError); {
+		case err == nil:
+			return &oauth2.Token{
+				AccessToken:  tok.AccessToken,
+				TokenType:    tok.TokenType,
+				RefreshToken: tok.RefreshToken,
+				Expiry:       time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+			}, nil
+		case e != nil && e.Code == "authorization_pending":
+		case e != nil && e.Code == "slow_down":
+			interval += 5 * devicePollUnit
+		default: // e.g. access_denied or expired_token
+			return nil, err
+		}
+	}
+}
+
+// fromPaste requests a token from the web, asking the user to paste the code, or the whole URL
+// of the page that the browser was redirected to, validating its state.
+func fromPaste(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	state, verifier := RandomString(24), NewVerifier()
+	authURL := config.AuthCodeURL(state, append(ChallengeOptions(verifier), oauth2.AccessTypeOffline)...)
+	fmt.Fprintf(os.Stderr, "Open this link in a browser, then paste the authorization code, or the "+
+		"whole URL of the page it redirects to, even if that fails to load: \n%v\n", authURL)
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		log.Fatalf("Unable to read authorization code: %v", err)
+	}
+	if u, err := url.Parse(authCode); err == nil && u.Query().Get("code") != "" {
+		if !sameState(u.Query().Get("state"), state) {
+			log.Fatalf("Unable to retrieve token from web: %v", ErrInvalidState)
+		}
+		authCode = u.Query().Get("code")
+	}
+
+	tok, err := config.Exchange(ctx, authCode, VerifierOption(verifier))
+	if err != nil {
+		log.Fatalf("Unable to retrieve token from web: %v", err)
+	}
+	return tok
+}
+
+// oauthError is an error response of an OAuth endpoint.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// postForm posts a form to an OAuth endpoint, decoding a JSON response to v, or an *oauthError.
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &oauthError{}
+		if json.Unmarshal(body, e) != nil || e.Code == "" {
+			return fmt.Errorf("%s: %s", resp.Status, body)
+		}
+		return e
+	}
+	return json.Unmarshal(body, v)
+}
+
+// headless returns true when there is likely no browser to redirect back to the loopback
+// interface from, e.g. over SSH or \wo a display.
+func headless() bool {
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		return true
+	}
+	return runtime.GOOS == "linux" && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
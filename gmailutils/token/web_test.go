@@ -0,0 +1,137 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// newFakeProvider returns a local OAuth provider, that authorizes everything
+// instantly for the loopback flow, and after a single poll for the device flow.
+func newFakeProvider(t *testing.T) *httptest.Server {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.Equal(t, "offline", q.Get("access_type"))
+		to := q.Get("redirect_uri") + "?" + url.Values{"code": {"loopback-code"}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, to, http.StatusFound)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gmail.readonly", r.FormValue("scope"))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code": "device-code", "user_code": "ABCD-EFGH", "verification_url": "https://example.com/device",
+			"expires_in": 60, "interval": 1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		r.ParseForm()
+		var access string
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			assert.Equal(t, "loopback-code", r.PostForm.Get("code"))
+			assert.NotEmpty(t, r.PostForm.Get("code_verifier"))
+			access = "loopback-access"
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			assert.Equal(t, "device-code", r.PostForm.Get("device_code"))
+			if polls++; polls == 1 {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				w.Write([]byte(`{"error": "authorization_pending"}`))
+				return
+			}
+			access = "device-access"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": access, "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600,
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFromLoopback(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.Close()
+	config := &oauth2.Config{
+		ClientID: "id", Scopes: []string{"gmail.readonly"},
+		Endpoint: oauth2.Endpoint{AuthURL: p.URL + "/auth", TokenURL: p.URL + "/token"},
+	}
+
+	browser := func(authURL string) error {
+		u, err := url.Parse(authURL)
+		require.NoError(t, err)
+		redirect := u.Query().Get("redirect_uri")
+		assert.Contains(t, redirect, "http://127.0.0.1:")
+
+		forged, err := http.Get(redirect + "?code=forged&state=forged")
+		require.NoError(t, err)
+		forged.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, forged.StatusCode)
+
+		resp, err := http.Get(authURL) // follows the redirect back to the loopback server
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return nil
+	}
+	tok, err := FromLoopback(context.Background(), config, browser)
+	require.NoError(t, err)
+	assert.Equal(t, "loopback-access", tok.AccessToken)
+
+	denied := func(authURL string) error {
+		u, _ := url.Parse(authURL)
+		q := u.Query()
+		resp, err := http.Get(q.Get("redirect_uri") + "?" + url.Values{"error": {"access_denied"}, "state": {q.Get("state")}}.Encode())
+		require.NoError(t, err)
+		resp.Body.Close()
+		return nil
+	}
+	_, err = FromLoopback(context.Background(), config, denied)
+	assert.Error(t, err)
+}
+
+func TestFromDevice(t *testing.T) {
+	defer func(unit time.Duration) { devicePollUnit = unit }(devicePollUnit)
+	devicePollUnit = time.Millisecond
+
+	p := newFakeProvider(t)
+	defer p.Close()
+	config := &oauth2.Config{
+		ClientID: "id", Scopes: []string{"gmail.readonly"},
+		Endpoint: oauth2.Endpoint{TokenURL: p.URL + "/token"},
+	}
+
+	tok, err := FromDevice(context.Background(), config, p.URL+"/device")
+	require.NoError(t, err)
+	assert.Equal(t, "device-access", tok.AccessToken)
+	assert.Equal(t, "refresh", tok.RefreshToken)
+	assert.True(t, tok.Expiry.After(time.Now()))
+
+	_, err = FromDevice(context.Background(), config, p.URL+"/missing")
+	assert.Error(t, err)
+}
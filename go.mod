@@ -7,15 +7,19 @@ require (
 	github.com/antchfx/htmlquery v1.2.0
 	github.com/antchfx/xpath v1.1.2 // indirect
 	github.com/cheggaaa/pb/v3 v3.0.3
+	github.com/emersion/go-imap v1.2.1
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/golang/groupcache v0.0.0-20191027212112-611e8accdfc9 // indirect
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/rs/cors v1.7.0
 	github.com/stretchr/testify v1.4.0
 	gitlab.com/golang-commonmark/markdown v0.0.0-20191124021542-fffb4bed7d15
+	go.etcd.io/bbolt v1.3.6
 	go.opencensus.io v0.22.2 // indirect
-	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.7.0
 	golang.org/x/oauth2 v0.0.0-20191122200657-5d9234df094c
+	golang.org/x/text v0.7.0
 	google.golang.org/api v0.14.0
 	google.golang.org/appengine v1.6.5 // indirect
 	google.golang.org/genproto v0.0.0-20191115221424-83cc0476cb11 // indirect
@@ -37,6 +37,14 @@ func ErrUnprocessable(w http.ResponseWriter, err error, msg string) {
 	return
 }
 
+func ErrBadRequest(w http.ResponseWriter, err error, msg string) {
+	jsonError(w, http.StatusBadRequest, ErrResponse{
+		Err:        err.Error(),
+		StatusText: msg,
+	})
+	return
+}
+
 func ErrUnauthorized(w http.ResponseWriter, url string) {
 	status := http.StatusUnauthorized
 	jsonError(w, status, ErrResponse{
@@ -53,3 +61,20 @@ func ErrFailedDependency(w http.ResponseWriter, err error, msg string) {
 	})
 	return
 }
+
+func ErrInternal(w http.ResponseWriter, err error, msg string) {
+	jsonError(w, http.StatusInternalServerError, ErrResponse{
+		Err:        err.Error(),
+		StatusText: msg,
+	})
+	return
+}
+
+func ErrReauth(w http.ResponseWriter, err error, url string) {
+	jsonError(w, http.StatusUnauthorized, ErrResponse{
+		Err:        err.Error(),
+		StatusText: "Access to Gmail has expired or was revoked, please log in again",
+		Redirect:   url,
+	})
+	return
+}
@@ -27,37 +27,72 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/bzz/scholar-alert-digest/gmailutils"
 	"github.com/bzz/scholar-alert-digest/papers"
+	"github.com/bzz/scholar-alert-digest/store"
 	"github.com/bzz/scholar-alert-digest/templates"
 
 	"google.golang.org/api/gmail/v1"
 )
 
 const (
-	labelName = "[-oss-]-_ml-in-se" // "[ OSS ]/_ML-in-SE" in the Web UI
+	labelName = "[ OSS ]/_ML-in-SE"
 
-	usageMessage = `usage: go run [-labels | -subj] [-html | -json] [-compact] [-mark] [-read] [-authors] [-refs] [-l <your-gmail-label>] [-n]
+	usageMessage = `usage: go run [-labels | -subj] [-html | -json] [-compact] [-mark] [-archive] [-apply-label <name>] [-trash] [-read] [-authors] [-refs] [-author <name>] [-venue <name>] [-host <domain>] [-min-year <year>] [-kind <alert>] [-sort freq|year|title] [-since <date>] [-until <date>] [-newer-than <period>] [-from <sender>] [-db <file> [-history <days> | -new-only | -review <paper> | -unreview <paper> | -reviewed-only]] [-l <your-gmail-label> [-sync <dir>] [-cache <dir>] | -mbox <file> | -maildir <dir> | -imap <host:port>] [-n] [-config <dir>] [-account <name>]
 
 Polls Gmail API for unread Google Scholar alert messaged under a given label,
 aggregates by paper title and prints a list of paper URLs in Markdown format.
 
 The -l flag sets the Gmail label to look for (overriden by 'SAD_LABEL' env variable).
+  Several comma-separated labels, or globs like 'research/*', produce a report section per label.
+The -mbox flag reads messages from a local mbox file instead of Gmail.
+The -maildir flag reads messages from a local Maildir instead of Gmail.
+The -imap flag reads messages from an IMAP server instead of Gmail, using -l as a folder name.
+  Credentials are read from 'SAD_IMAP_USER' and 'SAD_IMAP_PASSWORD' env variables.
+  The -mark flag sets the \Seen flag and -archive moves messages to the -imap-archive folder.
 The -n flag sets the number of concurent requests to Gmail API.
+The -config flag sets the directory of 'credentials.json' and the tokens (overrides 'SAD_CONFIG_DIR' env variable).
+  By default it is the current directory if it has 'credentials.json', or e.g. ~/.config/scholar-alert-digest.
+The -account flag keeps a separate token for a given account e.g. an email (default is 'SAD_ACCOUNT' env variable).
+  Tokens are encrypted by a passphrase from 'SAD_TOKEN_PASSPHRASE' env variable, if set, e.g. to run from cron.
+The -cache flag keeps all fetched messages in a given directory, up to -cache-size MB and -cache-age.
+The -sync flag keeps a local record of all messages under the label in a given directory,
+  so the next runs only fetch the changes from Gmail.
 The -labels flag will only print all available labels for the current account.
 The -subj flag will only include email subjects in the report. Usefull for " | uniq -c | sort -dr".
 The -html flag will produce ouput report in HTML format.
 The -json flag will produce output in JSONL format, one paper object per line.
 The -compact flag will produce ouput report in compact format, usefull >100 papers.
 The -mark flag will mark all the aggregated emails as read in Gmail.
+The -archive flag will remove all the aggregated emails from the inbox.
+The -apply-label flag will add a given label to all the aggregated emails, creating the label if missing.
+  Together with -archive it moves them e.g. to "Scholar/Processed".
+The -trash flag will move all the aggregated emails to the trash, not supported by -mbox and -maildir.
 The -read flag will include a new section in the report, aggregating all read emails.
 The -authors flag will include paper authors in the report.
 The -refs flag will add links to all email messages that mention each paper.
+The -author, -venue, -host and -min-year flags will only include the matching papers in the report.
+  Authors are only known with the -authors flag.
+The -kind flag will only include papers from alerts of a given kind: citations, articles, related, search or recommended.
+The -sort flag sets the order of papers in the report: by frequency (default), year or title.
+The -since and -until flags will only include emails received in a given range of days, as 2006-01-02.
+The -newer-than flag will only include emails newer than a given period e.g. 7d, 2m or 1y.
+The -from flag will only include emails from a given sender.
+  All these flags apply to both unread and -read emails.
+The -similarity flag sets a threshold (0..1] of title similarity to merge papers by, 1 disables fuzzy matching.
+The -db flag will record all the papers in a local database, to keep the history across runs.
+The -history flag will only print papers from the -db, seen in the given number of last days.
+The -new-only flag will skip papers from the -db that were already reported by previous runs.
+The -review and -unreview flags record a paper, by URL, ID or title, as reviewed or not in the -db.
+The -reviewed-only flag applies -mark, -archive, -apply-label and -trash only to the emails, all papers
+  of which were reviewed. Partially reviewed emails are kept as is.
 The -upd-test flag will write emails to ./fixtures/emails.json and quit.
 `
 )
@@ -65,7 +100,12 @@ The -upd-test flag will write emails to ./fixtures/emails.json and quit.
 var (
 	user = "me" // TODO(bzz): move to const in gmailutils
 
-	gmailLabel = flag.String("l", labelName, "name of the Gmail label")
+	gmailLabel = flag.String("l", labelName, "name of the Gmail label, or comma-separated names and globs")
+	mbox       = flag.String("mbox", "", "read messages from a local mbox file instead of Gmail")
+	maildir    = flag.String("maildir", "", "read messages from a local Maildir instead of Gmail")
+	imapAddr   = flag.String("imap", "", "read messages from an IMAP server at host:port instead of Gmail")
+	imapArch   = flag.String("imap-archive", "Archive", "IMAP folder to move messages to on -archive")
+	imapNoTLS  = flag.Bool("imap-insecure", false, "connect to the IMAP server without TLS")
 	listLabels = flag.Bool("labels", false, "list all Gmail labels")
 	// TODO(bzz): a format flag \w validated md/html/json options would be better
 	outputHTML = flag.Bool("html", false, "output report in HTML (instead of default Markdown)")
@@ -73,14 +113,84 @@ var (
 	compact    = flag.Bool("compact", false, "output report in compact format (>100 papers)")
 	markRead   = flag.Bool("mark", false, "marks all aggregated emails as read")
 	archive    = flag.Bool("archive", false, "removes emails from inbox")
+	applyLabel = flag.String("apply-label", "", "adds a label to all aggregated emails, creating it if missing")
+	trash      = flag.Bool("trash", false, "moves all aggregated emails to trash")
 	read       = flag.Bool("read", false, "include read emails to a separate section of the report")
 	authors    = flag.Bool("authors", false, "include paper authors in the report")
 	refs       = flag.Bool("refs", false, "include orignin references to Gmail messages in report")
+	byAuthor   = flag.String("author", "", "only include papers by an author, matching the given name")
+	byVenue    = flag.String("venue", "", "only include papers from a venue, matching the given name")
+	byHost     = flag.String("host", "", "only include papers from a given domain e.g. arxiv.org")
+	minYear    = flag.Int("min-year", 0, "only include papers published in or after the given year")
+	byKind     = flag.String("kind", "", "only include papers from alerts of a given kind e.g. citations")
+	sortBy     = flag.String("sort", "freq", "order of the papers in the report: freq, year or title")
+	similarity = flag.Float64("similarity", papers.TitleSimilarity, "threshold of title similarity to merge papers, 1 disables fuzzy matching")
+	since      = flag.String("since", "", "only include emails received on or after a given day, as 2006-01-02")
+	until      = flag.String("until", "", "only include emails received before a given day, as 2006-01-02")
+	fromAddr   = flag.String("from", "", "only include emails from a given sender")
+	newerThan  = flag.String("newer-than", "", "only include emails newer than a given period e.g. 7d, 2m or 1y")
 	onlySubj   = flag.Bool("subj", false, "aggregate only email subjects")
 	concurReq  = flag.Int("n", 10, "number of concurent Gmail API requests")
+	configDir  = flag.String("config", "", "directory of credentials.json and the tokens (default $SAD_CONFIG_DIR, ./ or the user config dir)")
+	account    = flag.String("account", os.Getenv("SAD_ACCOUNT"), "account to keep a separate token for e.g. an email")
+	cacheDir   = flag.String("cache", "", "directory to cache the fetched messages in")
+	cacheSize  = flag.Int64("cache-size", 100, "max size of the -cache, in MB")
+	cacheAge   = flag.Duration("cache-age", 30*24*time.Hour, "max age of messages in the -cache")
+	syncDir    = flag.String("sync", "", "directory to keep a local record of messages, only fetching the new ones from Gmail")
+	dbPath     = flag.String("db", "", "path to a local database, recording the history of all papers")
+	history    = flag.Int("history", 0, "print papers from -db, seen in the given number of last days")
+	newOnly    = flag.Bool("new-only", false, "only report papers from -db that were never reported before")
+	reviewOnly = flag.Bool("reviewed-only", false, "only apply -mark, -archive, -apply-label and -trash to emails with all papers reviewed")
 	updTest    = flag.Bool("upd-test", false, "save all emails to ./fixtures/*, to be used with the -test later")
 )
 
+// baseQuery returns a query for the messages under any label, honoring all the query flags.
+func baseQuery() (gmailutils.Query, error) {
+	q := gmailutils.Query{}.From(*fromAddr)
+	if *since != "" {
+		t, err := parseDay("since", *since)
+		if err != nil {
+			return q, err
+		}
+		q = q.After(t)
+	}
+	if *until != "" {
+		t, err := parseDay("until", *until)
+		if err != nil {
+			return q, err
+		}
+		q = q.Before(t)
+	}
+	if *newerThan != "" {
+		if err := gmailutils.ValidPeriod(*newerThan); err != nil {
+			return q, err
+		}
+		q = q.NewerThan(*newerThan)
+	}
+	return q, nil
+}
+
+func parseDay(flag, value string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("-%s %q is not a date as 2006-01-02", flag, value)
+	}
+	return t, nil
+}
+
+// stringsFlag is a flag that can be repeated, collecting all the values.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ", ") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+var reviewed, unreviewed stringsFlag
+
+func init() {
+	flag.Var(&reviewed, "review", "record a paper (by URL, ID or title) as reviewed in -db, can be repeated")
+	flag.Var(&unreviewed, "unreview", "record a paper (by URL, ID or title) as not reviewed in -db, can be repeated")
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, usageMessage)
 	os.Exit(0)
@@ -89,15 +199,53 @@ func usage() {
 func main() {
 	flag.Usage = usage
 	flag.Parse()
-
-	client := gmailutils.NewClient(*markRead)
-	srv, err := gmail.New(client)
+	papers.TitleSimilarity = *similarity
+	order, err := papers.OrderByName(*sortBy)
 	if err != nil {
-		log.Fatalf("Unable to create a Gmail client: %v", err)
+		log.Fatal(err)
+	}
+	papers.Order = order
+
+	filter := papers.Filter{Author: *byAuthor, Venue: *byVenue, Host: *byHost, MinYear: *minYear}
+	if *byKind != "" {
+		if filter.Kind, err = gmailutils.ParseAlertKind(*byKind); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var db *store.Store
+	if *dbPath != "" {
+		db = openStore(*dbPath)
+		defer db.Close()
+	} else if *history > 0 || *newOnly || len(reviewed) != 0 || len(unreviewed) != 0 || *reviewOnly {
+		log.Fatal("-history, -new-only, -review, -unreview and -reviewed-only require a -db to keep the papers in")
+	}
+
+	if *history > 0 {
+		printHistory(db, time.Now().AddDate(0, 0, -*history))
+		return
+	}
+
+	if len(reviewed) != 0 || len(unreviewed) != 0 {
+		now := time.Now()
+		if err := db.MarkReviewed(reviewed, true, now); err != nil {
+			log.Fatalf("Unable to save reviewed papers: %v", err)
+		}
+		if err := db.MarkReviewed(unreviewed, false, now); err != nil {
+			log.Fatalf("Unable to save reviewed papers: %v", err)
+		}
+		log.Printf("%d papers marked as reviewed, %d as not reviewed", len(reviewed), len(unreviewed))
+		return
+	}
+
+	ctx := context.Background()
+	src := newSource()
+	if c, ok := src.(io.Closer); ok { // e.g. to log out of IMAP
+		defer c.Close()
 	}
 
 	if *listLabels {
-		labels := gmailutils.PrintAllLabels(srv, user)
+		labels := gmailutils.PrintAllLabels(ctx, src)
 		if *updTest {
 			saveLabels("./fixtures/labels.json", labels)
 		}
@@ -109,39 +257,100 @@ func main() {
 		gmailLabel = &envLabel
 	}
 
+	base, err := baseQuery()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	labels := []string{""} // local mailboxes have no labels
+	if *mbox == "" && *maildir == "" {
+		labels, err = gmailutils.ExpandLabels(ctx, src, gmailutils.SplitLabels(*gmailLabel))
+		if err != nil {
+			log.Fatalf("Unable to find labels %q: %v", *gmailLabel, err)
+		}
+	}
+
 	if *onlySubj {
 		log.Print("only extracting the subjects from scholar emails")
-		query := fmt.Sprintf("label:%s from:scholaralerts-noreply is:unread", *gmailLabel)
-		if *read {
-			query = strings.TrimSuffix(query, " is:unread")
+		query := base
+		if *fromAddr == "" {
+			query = query.From("scholaralerts-noreply")
+		}
+		if !*read {
+			query = query.Unread()
 		}
 
-		msgs, err := gmailutils.FetchConcurent(context.Background(), srv, user, query, *concurReq)
-		if err != nil {
-			log.Fatalf("Failed to fetch messages from Gmail: %v", err)
+		var msgs []*gmail.Message
+		seen := map[string]bool{}
+		for _, label := range labels {
+			lMsgs, err := gmailutils.FetchConcurent(ctx, src, query.Label(label).String())
+			if err != nil {
+				log.Fatalf("Failed to fetch messages from Gmail: %v", err)
+			}
+			msgs = append(msgs, gmailutils.Unseen(lMsgs, seen)...)
 		}
 
 		printSubjects(msgs)
 		os.Exit(0)
 	}
 
-	// fetch messages, extract papers, aggregated by title
-	// TODO(bzz): FetchAsync returning chan *gmail.Message?
-	urMsgs, err := gmailutils.FetchConcurent(context.Background(), srv, user, fmt.Sprintf("label:%s is:unread", *gmailLabel), *concurReq)
-	if err != nil {
-		log.Fatalf("Failed to fetch messages from Gmail: %v", err)
+	// fetch messages, extract papers, aggregated by title, in a section per label
+	// refs are needed to count each email only once in history, and to filter by kind
+	withRefs := *refs || *dbPath != "" || *byKind != ""
+	var (
+		sections      []*papers.Section
+		urMsgs, rMsgs []*gmail.Message
+		totalErrCnt   int
+	)
+	urSeen, rSeen := map[string]bool{}, map[string]bool{} // emails under several labels count once
+	for _, label := range labels {
+		query := base.Label(label)
+		msgs, unreadStats, unreadPapers, err := fetchAndExtract(ctx, src, query.Unread().String(), urSeen, withRefs)
+		if err != nil {
+			log.Fatalf("Failed to fetch messages from Gmail: %v", err)
+		}
+		urMsgs = append(urMsgs, msgs...)
+		totalErrCnt += unreadStats.Errs
+
+		section := &papers.Section{Stats: unreadStats, Unread: unreadPapers}
+		if len(labels) > 1 {
+			section.Label = label
+		}
+		if *read {
+			msgs, readStats, readPapers, err := fetchAndExtract(ctx, src, query.Read().String(), rSeen, withRefs)
+			if err != nil {
+				log.Fatal("Failed to fetch messages from Gmail")
+			}
+			rMsgs = append(rMsgs, msgs...)
+			totalErrCnt += readStats.Errs
+			section.Read = readPapers
+		}
+		sections = append(sections, section)
 	}
-	unreadStats, unreadPapers := papers.ExtractAndAggPapersFromMsgs(urMsgs, *authors, *refs)
+	papers.DedupSections(sections)
 
-	readStats := &papers.Stats{}
-	var rMsgs []*gmail.Message
-	var readPapers papers.AggPapers
-	if *read {
-		rMsgs, err = gmailutils.FetchConcurent(context.Background(), srv, user, fmt.Sprintf("label:%s is:read", *gmailLabel), *concurReq)
-		if err != nil {
-			log.Fatal("Failed to fetch messages from Gmail")
+	actMsgs := urMsgs // emails to apply the actions to e.g. -mark
+	if *reviewOnly {
+		actMsgs = reviewedMsgs(db, sections, urMsgs)
+	}
+
+	nPapers := 0
+	for _, s := range sections {
+		if db != nil {
+			recordPapers(db, s.Unread, s.Read)
 		}
-		readStats, readPapers = papers.ExtractAndAggPapersFromMsgs(rMsgs, *authors, *refs)
+
+		if *newOnly {
+			s.Unread = unreportedPapers(db, s.Unread)
+			s.Read = unreportedPapers(db, s.Read)
+		}
+
+		s.Unread, s.Read = filter.Apply(s.Unread), filter.Apply(s.Read)
+		if !*refs {
+			dropRefs(s.Unread)
+			dropRefs(s.Read)
+		}
+		nPapers += len(s.Unread) + len(s.Read)
 	}
 
 	if *updTest {
@@ -156,7 +365,7 @@ func main() {
 		template, style = templates.CompactMdTemplText, templates.CompatStyle
 	}
 
-	log.Printf("rendering %d papers", len(unreadPapers)+len(readPapers))
+	log.Printf("rendering %d papers", nPapers)
 	if *outputJSON {
 		r = templates.NewJSONLRenderer()
 	} else if *outputHTML {
@@ -164,24 +373,128 @@ func main() {
 	} else {
 		r = templates.NewMarkdownRenderer(template, templates.ReadMdTemplText)
 	}
-	r.Render(os.Stdout, unreadStats, unreadPapers, readPapers)
+	r.RenderSections(os.Stdout, sections)
 
-	if *markRead {
-		// TODO(bzz): add a state
-		//  use existing report from FS \w a checkbox state set by the user
-		//  only mark email as "read" iff all the links are checked off
-		gmailutils.ModifyMsgsDelLabel(srv, user, urMsgs, "UNREAD")
-		if *archive {
-			gmailutils.ModifyMsgsDelLabel(srv, user, urMsgs, "INBOX")
+	if db != nil {
+		now := time.Now()
+		for _, s := range sections {
+			for _, agg := range []papers.AggPapers{s.Unread, s.Read} {
+				if err := db.MarkReported(agg, now); err != nil {
+					log.Fatalf("Unable to save reported papers: %v", err)
+				}
+			}
+		}
+	}
+
+	if add, remove := emailActions(); len(add) != 0 || len(remove) != 0 {
+		if err := gmailutils.ModifyMsgs(ctx, src, actMsgs, add, remove); err != nil {
+			log.Fatalf("Unable to modify emails: %v", err)
+		}
+	}
+	if *trash {
+		if err := gmailutils.TrashMsgs(ctx, src, actMsgs); err != nil {
+			log.Fatalf("Unable to move emails to the trash: %v", err)
 		}
 	}
 
-	totalErrCnt := unreadStats.Errs + readStats.Errs
 	if totalErrCnt != 0 {
 		log.Printf("Errors: failed to parse %d email (more individual papeprs might be skipped, see logs above)\n", totalErrCnt)
 	}
 }
 
+// emailActions returns labels to add to and remove from the aggregated emails, by CLI flags.
+func emailActions() (add, remove []string) {
+	if *markRead {
+		remove = append(remove, "UNREAD")
+	}
+	if *archive {
+		remove = append(remove, "INBOX")
+	}
+	if *applyLabel != "" {
+		add = append(add, *applyLabel)
+	}
+	return add, remove
+}
+
+// newSource returns a source of messages, configured by CLI flags.
+func newSource() gmailutils.MessageSource {
+	switch {
+	case *mbox != "":
+		src, err := gmailutils.NewMboxSource(*mbox)
+		if err != nil {
+			log.Fatalf("Unable to read mbox: %v", err)
+		}
+		return src
+	case *maildir != "":
+		src, err := gmailutils.NewMaildirSource(*maildir)
+		if err != nil {
+			log.Fatalf("Unable to read maildir: %v", err)
+		}
+		return src
+	case *imapAddr != "":
+		src, err := gmailutils.DialIMAP(*imapAddr, os.Getenv("SAD_IMAP_USER"), os.Getenv("SAD_IMAP_PASSWORD"), !*imapNoTLS, *imapArch)
+		if err != nil {
+			log.Fatalf("Unable to connect to IMAP: %v", err)
+		}
+		return src
+	}
+
+	add, remove := emailActions()
+	client := gmailutils.NewClient(gmailutils.ClientConfig{
+		Dir:        *configDir,
+		Account:    *account,
+		Passphrase: os.Getenv("SAD_TOKEN_PASSPHRASE"),
+		Write:      len(add) != 0 || len(remove) != 0 || *trash,
+	})
+	src, err := gmailutils.NewGmailSource(client, user, *concurReq)
+	if err != nil {
+		log.Fatalf("Unable to create a Gmail client: %v", err)
+	}
+	if *cacheDir != "" {
+		cache, err := gmailutils.NewCache(*cacheDir, *cacheSize<<20, *cacheAge)
+		if err != nil {
+			log.Fatalf("Unable to create a message cache: %v", err)
+		}
+		src.SetCache(cache)
+	}
+	if *syncDir != "" {
+		return gmailutils.NewSyncSource(src, *syncDir)
+	}
+	return src
+}
+
+// fetchAndExtract streams the messages matching a query from the source, extracting
+// papers while the rest is being fetched. Returns all the messages and the papers.
+// Messages that were already seen are skipped, and all the rest are added to seen.
+func fetchAndExtract(ctx context.Context, src gmailutils.MessageSource, query string, seen map[string]bool, withRefs bool) (
+	[]*gmail.Message, *papers.Stats, papers.AggPapers, error,
+) {
+	log.Printf("searching and fetching messages: %q", query)
+	msgs, errc := gmailutils.FetchAsync(ctx, src, query)
+
+	var all []*gmail.Message
+	tee := make(chan *gmail.Message)
+	go func() {
+		defer close(tee)
+		for m := range msgs {
+			if seen[m.Id] {
+				continue
+			}
+			seen[m.Id] = true
+			all = append(all, m)
+			tee <- m
+		}
+	}()
+	st, agg := papers.ExtractAndAggPapersFromChan(tee, *authors, withRefs)
+
+	err := <-errc
+	if fe, ok := err.(*gmailutils.FetchError); ok { // still report the rest
+		log.Printf("Skipping %d messages: %v", len(fe.Errs), fe)
+		err = nil
+	}
+	return all, st, agg, err
+}
+
 func saveEmails(path string, emails []*gmail.Message) {
 	log.Printf("Saving emails to fixtures at: %s\n", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
@@ -189,7 +502,7 @@ func saveEmails(path string, emails []*gmail.Message) {
 		log.Fatalf("Unable to save email fixtures: %v", err)
 	}
 	defer f.Close()
-	json.NewEncoder(f).Encode(append(emails))
+	json.NewEncoder(f).Encode(emails)
 }
 
 func saveLabels(path string, labels []*gmail.Label) {
@@ -202,17 +515,97 @@ func saveLabels(path string, labels []*gmail.Label) {
 	json.NewEncoder(f).Encode(labels)
 }
 
+func openStore(path string) *store.Store {
+	db, err := store.Open(path)
+	if err != nil {
+		log.Fatalf("Unable to open the database: %v", err)
+	}
+	return db
+}
+
+// recordPapers saves all the given papers to the history database.
+func recordPapers(db *store.Store, aggs ...papers.AggPapers) {
+	now := time.Now()
+	for _, agg := range aggs {
+		if err := db.Add(agg, now); err != nil {
+			log.Fatalf("Unable to save papers: %v", err)
+		}
+	}
+}
+
+// unreportedPapers filters out all the papers, reported by the previous runs.
+func unreportedPapers(db *store.Store, agg papers.AggPapers) papers.AggPapers {
+	fresh, err := db.Unreported(agg)
+	if err != nil {
+		log.Fatalf("Unable to read reported papers: %v", err)
+	}
+	log.Printf("skipping %d papers, already reported before", len(agg)-len(fresh))
+	return fresh
+}
+
+// reviewedMsgs returns only the messages, all the unread papers of which were reviewed.
+func reviewedMsgs(db *store.Store, sections []*papers.Section, msgs []*gmail.Message) []*gmail.Message {
+	unread := papers.AggPapers{}
+	for _, s := range sections {
+		for k, p := range s.Unread {
+			unread[k] = p
+		}
+	}
+	ids, err := db.ReviewedMessages(unread)
+	if err != nil {
+		log.Fatalf("Unable to read reviewed papers: %v", err)
+	}
+
+	done := map[string]bool{}
+	for _, id := range ids {
+		done[id] = true
+	}
+	var res []*gmail.Message
+	for _, m := range msgs {
+		if done[m.Id] {
+			res = append(res, m)
+		}
+	}
+	log.Printf("%d of %d emails have all the papers reviewed", len(res), len(msgs))
+	return res
+}
+
+func dropRefs(agg papers.AggPapers) {
+	for _, p := range agg {
+		p.Refs = nil
+	}
+}
+
+// printHistory prints all papers from the database, seen since a given time.
+func printHistory(db *store.Store, since time.Time) {
+	recs, err := db.Since(since)
+	if err != nil {
+		log.Fatalf("Unable to read papers: %v", err)
+	}
+
+	log.Printf("%d papers seen since %s", len(recs), since.Format("2006-01-02"))
+	encoder := json.NewEncoder(os.Stdout)
+	for _, r := range recs {
+		if *outputJSON {
+			encoder.Encode(r)
+			continue
+		}
+		fmt.Printf("%3d | %s | %s | %s\n",
+			r.Freq, r.FirstSeen.Format("2006-01-02"), r.LastSeen.Format("2006-01-02"), r.Title)
+	}
+}
+
 func printSubjects(msgs []*gmail.Message) {
 	var subjs []string
 	for _, m := range msgs {
 		subj := gmailutils.Subject(m.Payload)
-		srcType := gmailutils.NormalizeAndSplit(subj)
-		if len(srcType) != 2 {
-			log.Printf("subject %q does not match EN, FR or RU locales patterns", subj)
+		src, kind := gmailutils.NormalizeAndSplit(subj)
+		if kind == gmailutils.UnknownAlert {
+			log.Printf("subject %q does not match any of the known locales patterns", subj)
 			continue
 		}
 
-		subjs = append(subjs, fmt.Sprintf("%-22s | %s", srcType[1], srcType[0]))
+		subjs = append(subjs, fmt.Sprintf("%-22s | %s", kind, src))
 	}
 	sort.Strings(subjs)
 	for _, s := range subjs {
@@ -0,0 +1,172 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package papers
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// TitleSimilarity is a threshold of token-set similarity of normalized titles
+// above which two papers are considered the same. Value of 1 disables fuzzy matching.
+var TitleSimilarity = 0.9
+
+var folder = cases.Fold()
+
+// NormalizeTitle returns a title with case folded, ligatures decomposed,
+// diacritics and punctuation dropped, and whitespace collapsed.
+func NormalizeTitle(title string) string {
+	var b strings.Builder
+	space := true // no leading space
+	for _, r := range norm.NFKD.String(folder.String(title)) {
+		switch {
+		case unicode.Is(unicode.Mn, r): // diacritics
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			space = false
+		case !space: // whitespace, dashes, punctuation and symbols
+			b.WriteRune(' ')
+			space = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), " ")
+}
+
+// similarity returns Jaccard index of the two sets of tokens.
+func similarity(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for t := range a {
+		if b[t] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+func tokenSet(normTitle string) map[string]bool {
+	set := map[string]bool{}
+	for _, t := range strings.Fields(normTitle) {
+		set[t] = true
+	}
+	return set
+}
+
+// aggregator merges papers \w the same canonical ID, normalized title or
+// similar enough titles, keeping all the Refs.
+//
+// Papers are keyed by the canonical ID, if any, or by the normalized title.
+type aggregator struct {
+	threshold float64
+	papers    AggPapers
+
+	keys   []string                   // in order of insertion
+	tokens map[string]map[string]bool // key -> tokens of a normalized title
+	titles map[string]string          // normalized title -> key
+	ids    map[string]string          // canonical ID -> key
+}
+
+func newAggregator(threshold float64) *aggregator {
+	return &aggregator{
+		threshold: threshold,
+		papers:    AggPapers{},
+		tokens:    map[string]map[string]bool{},
+		titles:    map[string]string{},
+		ids:       map[string]string{},
+	}
+}
+
+func (a *aggregator) add(paper *Paper) {
+	title := NormalizeTitle(paper.Title)
+	if title == "" {
+		title = paper.Title
+	}
+
+	key, found := a.find(paper.ID, title)
+	if paper.ID != "" {
+		a.ids[paper.ID] = key
+	}
+	a.titles[title] = key
+
+	if found {
+		p := a.papers[key]
+		p.Freq += paper.Freq
+		p.Refs = append(p.Refs, paper.Refs...)
+		fillMissing(p, paper)
+		return
+	}
+
+	a.papers[key] = paper
+	a.keys = append(a.keys, key)
+	a.tokens[key] = tokenSet(title)
+}
+
+// find returns the key of an already aggregated paper that matches the given
+// canonical ID and normalized title, or a new key for it.
+func (a *aggregator) find(id, title string) (string, bool) {
+	if k, ok := a.ids[id]; ok && id != "" {
+		return k, true
+	}
+	if k, ok := a.titles[title]; ok {
+		return k, true
+	}
+
+	key := title
+	if id != "" {
+		key = id
+	}
+	if a.threshold >= 1 {
+		return key, false
+	}
+
+	tokens := tokenSet(title)
+	best, bestSim := "", 0.0
+	for _, k := range a.keys {
+		if sim := similarity(tokens, a.tokens[k]); sim >= a.threshold && sim > bestSim {
+			best, bestSim = k, sim
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+	return key, false
+}
+
+// fillMissing copies the details that are missing in one paper from its duplicate.
+func fillMissing(p, dup *Paper) {
+	if p.ID == "" {
+		p.ID = dup.ID
+	}
+	if len(p.Authors) == 0 {
+		p.Authors, p.EtAl = dup.Authors, dup.EtAl
+	}
+	if p.Venue == "" {
+		p.Venue = dup.Venue
+	}
+	if p.Year == 0 {
+		p.Year = dup.Year
+	}
+	if p.Host == "" {
+		p.Host = dup.Host
+	}
+}
@@ -0,0 +1,133 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package papers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bzz/scholar-alert-digest/gmailutils"
+)
+
+// Less reports whether paper a should be listed before paper b.
+type Less func(a, b *Paper) bool
+
+// Order is used by SortedKeys. Most frequent papers go first, by default.
+var Order Less = ByFreq
+
+// ByFreq orders papers by frequency, most frequent first.
+func ByFreq(a, b *Paper) bool { return a.Freq > b.Freq }
+
+// ByYear orders papers by year, most recent first, and then by frequency.
+func ByYear(a, b *Paper) bool {
+	if a.Year != b.Year {
+		return a.Year > b.Year
+	}
+	return ByFreq(a, b)
+}
+
+// ByTitle orders papers by title, alphabetically.
+func ByTitle(a, b *Paper) bool { return NormalizeTitle(a.Title) < NormalizeTitle(b.Title) }
+
+// OrderByName returns an order by its name: "freq", "year" or "title".
+func OrderByName(name string) (Less, error) {
+	switch name {
+	case "", "freq":
+		return ByFreq, nil
+	case "year":
+		return ByYear, nil
+	case "title":
+		return ByTitle, nil
+	}
+	return nil, fmt.Errorf("unknown sort order %q, must be one of: freq, year, title", name)
+}
+
+// Filter selects papers by their publication details.
+// Zero values of the fields match any paper.
+type Filter struct {
+	Author  string // case-insensitive substring of any author's name
+	Venue   string // case-insensitive substring of the venue
+	Host    string // a domain or a sub-domain of it e.g. "arxiv.org"
+	MinYear int
+	MaxYear int
+	Kind    gmailutils.AlertKind // any of the Refs is of this kind, requires Refs
+}
+
+// IsEmpty returns true if the filter matches any paper.
+func (f Filter) IsEmpty() bool {
+	return f == Filter{}
+}
+
+// Match returns true if the paper satisfies all the conditions of the filter.
+// Papers \wo a year are skipped by the year filters.
+func (f Filter) Match(p *Paper) bool {
+	if f.Author != "" && !matchAuthor(p, f.Author) {
+		return false
+	}
+	if f.Venue != "" && !containsFold(p.Venue, f.Venue) {
+		return false
+	}
+	if f.Host != "" && p.Host != strings.ToLower(f.Host) && !strings.HasSuffix(p.Host, "."+strings.ToLower(f.Host)) {
+		return false
+	}
+	if f.Kind != gmailutils.UnknownAlert && !hasKind(p.Refs, f.Kind) {
+		return false
+	}
+	if f.MinYear != 0 && (p.Year == 0 || p.Year < f.MinYear) {
+		return false
+	}
+	if f.MaxYear != 0 && (p.Year == 0 || p.Year > f.MaxYear) {
+		return false
+	}
+	return true
+}
+
+// Apply returns only the papers that match the filter.
+func (f Filter) Apply(agg AggPapers) AggPapers {
+	if f.IsEmpty() || agg == nil {
+		return agg
+	}
+	res := AggPapers{}
+	for key, p := range agg {
+		if f.Match(p) {
+			res[key] = p
+		}
+	}
+	return res
+}
+
+func matchAuthor(p *Paper, name string) bool {
+	for _, a := range p.Authors {
+		if containsFold(a.String(), name) {
+			return true
+		}
+	}
+	return containsFold(p.Author, name)
+}
+
+func hasKind(refs []Ref, kind gmailutils.AlertKind) bool {
+	for _, r := range refs {
+		if r.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(folder.String(s), folder.String(substr))
+}
@@ -0,0 +1,70 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package papers
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// idPattern extracts a canonical paper identifier from the URL, matched by the regexp.
+type idPattern struct {
+	prefix string
+	re     *regexp.Regexp
+}
+
+// idPatterns are checked in order, first match wins.
+var idPatterns = []idPattern{
+	{"arxiv:", regexp.MustCompile(`(?i)arxiv\.org/(?:abs|pdf|format)/([a-z-]+(?:\.[a-z]{2})?/\d{7}|\d{4}\.\d{4,5})`)},
+	{"arxiv:", regexp.MustCompile(`(?i)doi\.org/10\.48550/arxiv\.(\d{4}\.\d{4,5})`)},
+	{"doi:", regexp.MustCompile(`(?i)(?:doi\.org|/doi(?:/(?:abs|full|pdf|fullHtml|epdf|book))?|link\.springer\.com/(?:article|chapter|content/pdf))/(10\.\d{4,9}/[^?#&\s]+)`)},
+	{"acl:", regexp.MustCompile(`(?i)(?:aclanthology\.org|aclweb\.org/anthology)/([a-z0-9][a-z0-9.-]*\d)(?:\.pdf)?/?(?:[?#]|$)`)},
+	{"openreview:", regexp.MustCompile(`openreview\.net/(?:forum|pdf)\?(?:.*&)?id=([A-Za-z0-9_-]+)`)},
+	{"s2:", regexp.MustCompile(`(?i)semanticscholar\.org/paper/(?:[^/?#]+/)?([0-9a-f]{40})`)},
+	{"pmid:", regexp.MustCompile(`(?i)(?:pubmed\.ncbi\.nlm\.nih\.gov|ncbi\.nlm\.nih\.gov/pubmed)/(\d+)`)},
+	{"pmcid:", regexp.MustCompile(`(?i)ncbi\.nlm\.nih\.gov/pmc/articles/(PMC\d+)`)},
+}
+
+// CanonicalID returns an identifier of a paper (DOI, arXiv, ACL Anthology,
+// OpenReview, Semantic Scholar or PubMed) recognized from the paper URL, if any.
+// Different URLs of the same paper e.g. arxiv.org/abs and arxiv.org/pdf have the same ID.
+func CanonicalID(paperURL string) string {
+	if u, err := url.PathUnescape(paperURL); err == nil {
+		paperURL = u
+	}
+
+	for _, p := range idPatterns {
+		m := p.re.FindStringSubmatch(paperURL)
+		if m == nil {
+			continue
+		}
+
+		id := m[1]
+		switch p.prefix {
+		case "doi:": // case-insensitive, as defined by the DOI handbook
+			id = strings.TrimSuffix(strings.ToLower(id), ".pdf")
+			id = strings.TrimRight(id, "/.")
+		case "arxiv:", "acl:":
+			id = strings.ToLower(id)
+		case "pmcid:":
+			id = strings.ToUpper(id)
+		}
+		return p.prefix + id
+	}
+	return ""
+}
@@ -24,7 +24,13 @@ var scholarURLPrefix = regexp.MustCompile(`http(s)?://scholar\.google\.\p{L}+(\.
 type Paper struct {
 	Title    string
 	URL      string
-	Author   string `json:",omitempty"`
+	ID       string   `json:",omitempty"` // canonical identifier e.g. "doi:10.1145/3212695", see CanonicalID
+	Author   string   `json:",omitempty"`
+	Authors  []Author `json:",omitempty"`
+	EtAl     bool     `json:",omitempty"` // Authors are truncated
+	Venue    string   `json:",omitempty"`
+	Year     int      `json:",omitempty"`
+	Host     string   `json:",omitempty"` // e.g. "arxiv.org", as shown by Scholar
 	Abstract Abstract
 	Refs     []Ref `json:",omitempty"`
 	Freq     int
@@ -33,6 +39,8 @@ type Paper struct {
 // Ref saves information about a source, referencing the paper.
 type Ref struct {
 	ID, Title string
+	Kind      gmailutils.AlertKind `json:",omitempty"` // why the paper was sent
+	Subject   string               `json:",omitempty"`
 }
 
 // Abstract represents a view of the parsed abstract.
@@ -50,35 +58,57 @@ type Stats struct {
 
 // Helpers for a Map, sorted by keys.
 type sortedMap struct {
-	m AggPapers
-	s []string
+	m    AggPapers
+	s    []string
+	less Less
 }
 
-func (sm *sortedMap) Len() int           { return len(sm.m) }
-func (sm *sortedMap) Less(i, j int) bool { return sm.m[sm.s[i]].Freq > sm.m[sm.s[j]].Freq }
-func (sm *sortedMap) Swap(i, j int)      { sm.s[i], sm.s[j] = sm.s[j], sm.s[i] }
+func (sm *sortedMap) Len() int { return len(sm.m) }
+func (sm *sortedMap) Less(i, j int) bool {
+	a, b := sm.m[sm.s[i]], sm.m[sm.s[j]]
+	if sm.less(a, b) != sm.less(b, a) {
+		return sm.less(a, b)
+	}
+	return sm.s[i] < sm.s[j]
+}
+func (sm *sortedMap) Swap(i, j int) { sm.s[i], sm.s[j] = sm.s[j], sm.s[i] }
 
-// SortedKeys sort the given map by key.
+// SortedKeys sort the given map by the paper Order, and then by key.
 func SortedKeys(m AggPapers) []string {
 	sm := new(sortedMap)
 	sm.m = m
+	sm.less = Order
 	sm.s = make([]string, len(m))
 	i := 0
 	for key := range m {
 		sm.s[i] = key
 		i++
 	}
-	// TODO(bzz): use a stable sort
 	sort.Sort(sm)
 	return sm.s
 }
 
 // ExtractAndAggPapersFromMsgs parses mail messages and creates Papers, aggregated by title.
+//
+// Papers are keyed by a canonical ID if there is one, or by a normalized title otherwise.
+// The ones \w the same ID, or similar titles (see TitleSimilarity), are merged together.
 func ExtractAndAggPapersFromMsgs(msgs []*gmail.Message, authors, refs bool) (*Stats, AggPapers) {
-	st := &Stats{Msgs: len(msgs)}
-	uniqTitles := AggPapers{}
-
+	ch := make(chan *gmail.Message, len(msgs))
 	for _, m := range msgs {
+		ch <- m
+	}
+	close(ch)
+	return ExtractAndAggPapersFromChan(ch, authors, refs)
+}
+
+// ExtractAndAggPapersFromChan is the same as ExtractAndAggPapersFromMsgs, but processes
+// messages as they arrive e.g. from gmailutils.FetchAsync, until the channel is closed.
+func ExtractAndAggPapersFromChan(msgs <-chan *gmail.Message, authors, refs bool) (*Stats, AggPapers) {
+	st := &Stats{}
+	agg := newAggregator(TitleSimilarity)
+
+	for m := range msgs {
+		st.Msgs++
 		papers, err := extractPapersFromMsg(m, authors)
 		if err != nil {
 			st.Errs++
@@ -94,17 +124,11 @@ func ExtractAndAggPapersFromMsgs(msgs []*gmail.Message, authors, refs bool) (*St
 			if !refs {
 				paper.Refs = nil
 			}
-
-			if p, ok := uniqTitles[paper.Title]; ok {
-				p.Freq += paper.Freq
-				p.Refs = append(p.Refs, paper.Refs...)
-			} else {
-				uniqTitles[paper.Title] = paper
-			}
+			agg.add(paper)
 		}
 	}
 
-	return st, uniqTitles
+	return st, agg.papers
 }
 
 func extractPapersFromMsg(m *gmail.Message, inclAuthors bool) ([]*Paper, error) {
@@ -155,13 +179,22 @@ func extractPapersFromMsg(m *gmail.Message, inclAuthors bool) ([]*Paper, error)
 		return nil, fmt.Errorf("abstract: not valid XPath expression %q", xpAbs)
 	}
 
+	// source of the alert is shown for authors and papers, also in unknown locales, but not search queries
+	mSrc, kind := gmailutils.NormalizeAndSplit(subj)
+	if kind == gmailutils.Search || strings.Contains(mSrc, `"`) {
+		mSrc = ""
+	}
+
 	var papers []*Paper
 	var author string
 	for i, aTitle := range titles {
 		title := strings.TrimSpace(htmlquery.InnerText(aTitle))
 		abstract := strings.TrimSpace(htmlquery.InnerText(abss[i]))
+		pub := ParsePublication(htmlquery.InnerText(auths[i]))
 		if inclAuthors {
 			author = extractPaperAuthor(htmlquery.InnerText(auths[i]))
+		} else {
+			pub.Authors, pub.EtAl = nil, false
 		}
 
 		url, err := extractPaperURL(htmlquery.InnerText(urls[i]))
@@ -174,36 +207,27 @@ func extractPapersFromMsg(m *gmail.Message, inclAuthors bool) ([]*Paper, error)
 		first, rest := separateFirstLine(abstract, N, lookahead)
 		abs := Abstract{first, rest}
 
-		mSrc := ""
-		if srcType := gmailutils.NormalizeAndSplit(subj); len(srcType) == 2 {
-			// FIXME(bzz): this is a hack, replace it by switch over
-			// some exported types e.g gmailutils.Citations
-			if (strings.Index(srcType[1], "articles") > 0 ||
-				strings.Index(srcType[1], "citations") > 0 ||
-				strings.Index(srcType[1], "research") > 0) &&
-				strings.Index(srcType[0], `"`) == -1 {
-				mSrc = srcType[0]
-			}
-		}
-
 		papers = append(papers,
 			&Paper{
-				title, url, author, abs,
-				[]Ref{Ref{m.Id, mSrc}},
-				1,
+				Title:    title,
+				URL:      url,
+				ID:       CanonicalID(url),
+				Author:   author,
+				Authors:  pub.Authors,
+				EtAl:     pub.EtAl,
+				Venue:    pub.Venue,
+				Year:     pub.Year,
+				Host:     pub.Host,
+				Abstract: abs,
+				Refs:     []Ref{{ID: m.Id, Title: mSrc, Kind: kind, Subject: subj}},
+				Freq:     1,
 			})
 	}
 	return papers, nil
 }
 
 func extractPaperAuthor(publication string) string {
-	auth := publication
-	for i, r := range publication {
-		if unicode.In(r, unicode.Dash) {
-			auth = strings.TrimRightFunc(publication[:i], unicode.IsSpace)
-			break
-		}
-	}
+	auth := splitOnSpacedDash(strings.TrimSpace(publication))[0]
 	return strings.Title(strings.ToLower(auth))
 }
 
@@ -1,6 +1,7 @@
 package papers
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strings"
 	"testing"
@@ -9,6 +10,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/bzz/scholar-alert-digest/gmailutils"
 )
 
 // UnitTests for paper extraction.
@@ -146,3 +150,218 @@ func BenchmarkAbstractFirstLineSimpler(b *testing.B) {
 		}
 	}
 }
+
+func TestNormalizeTitle(t *testing.T) {
+	var testCases = []struct {
+		title, norm string
+	}{
+		{"Deep Learning for Code", "deep learning for code"},
+		{"Deep learning for code.", "deep learning for code"},
+		{"  Code2vec: learning   distributed representations of code ", "code2vec learning distributed representations of code"},
+		{"Self‐supervised contrastive learning — a survey", "self supervised contrastive learning a survey"},
+		{"Eﬃcient ﬁne-tuning", "efficient fine tuning"},
+		{"Sémantique des langages à objets", "semantique des langages a objets"},
+		{"Größe", "grosse"},
+		{"Многие методы преобразования программ", "многие методы преобразования программ"},
+		{"?!", ""},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.norm, NormalizeTitle(tc.title), tc.title)
+	}
+}
+
+func TestExtractPapersSource(t *testing.T) {
+	body := `<h3><a href="http://scholar.google.com/scholar_url?url=https://arxiv.org/abs/1709.06182&amp;hl=en">A Survey of Machine Learning for Big Code</a></h3>
+<div>M Allamanis, ET Barr - arXiv preprint, 2017</div>
+<div>Research at the intersection of machine learning, programming languages, and software engineering.</div>`
+
+	var testCases = []struct {
+		subj, src string
+		kind      gmailutils.AlertKind
+	}{
+		{"Miltiadis Allamanis - new articles", "Miltiadis Allamanis", gmailutils.Articles},
+		{"Miltiadis Allamanis - nuovi articoli", "Miltiadis Allamanis", gmailutils.UnknownAlert}, // it, not supported
+		{`"big code" - nuovi risultati`, "", gmailutils.UnknownAlert},
+		{`"big code" - new results`, "", gmailutils.Search},
+		{"Новые результаты по запросу big code", "", gmailutils.Search},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.subj, func(t *testing.T) {
+			m := &gmail.Message{Id: "1", Payload: &gmail.MessagePart{
+				MimeType: "text/html",
+				Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: tc.subj}},
+				Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(body))},
+			}}
+			papers, err := extractPapersFromMsg(m, false)
+			require.NoError(t, err)
+			require.Len(t, papers, 1)
+			assert.Equal(t, "https://arxiv.org/abs/1709.06182", papers[0].URL)
+			assert.Equal(t, []Ref{{ID: "1", Title: tc.src, Kind: tc.kind, Subject: tc.subj}}, papers[0].Refs)
+		})
+	}
+}
+
+func TestAggregateSimilarPapers(t *testing.T) {
+	papers := []*Paper{
+		{Title: "Deep Learning for Code", URL: "https://example.org/1", Refs: []Ref{{ID: "1"}}, Freq: 1},
+		{Title: "Deep learning for code.", URL: "https://example.org/2", Refs: []Ref{{ID: "2"}}, Freq: 1},
+		{Title: "A Survey of Machine Learning for Big Code and Naturalness", URL: "https://dl.acm.org/doi/10.1145/3212695", Refs: []Ref{{ID: "3"}}, Freq: 1},
+		{Title: "A survey of machine learning for big code and naturalness (extended)", URL: "https://arxiv.org/abs/1709.06182", Refs: []Ref{{ID: "4"}}, Freq: 1},
+		{Title: "Learning to Represent Edits", URL: "https://arxiv.org/abs/1810.13337v2", Refs: []Ref{{ID: "5"}}, Freq: 1},
+		{Title: "Learning to represent edits [PDF]", URL: "https://arxiv.org/pdf/1810.13337.pdf", Refs: []Ref{{ID: "6"}}, Freq: 1},
+		{Title: "Learning to Represent Programs", URL: "https://example.org/3", Refs: []Ref{{ID: "7"}}, Freq: 1},
+	}
+
+	agg := newAggregator(0.9)
+	for _, p := range papers {
+		cp := *p
+		cp.ID = CanonicalID(cp.URL)
+		agg.add(&cp)
+	}
+	require.Len(t, agg.papers, 4)
+
+	code := agg.papers["deep learning for code"]
+	require.NotNil(t, code)
+	assert.Equal(t, "Deep Learning for Code", code.Title)
+	assert.Equal(t, 2, code.Freq)
+	assert.Equal(t, []Ref{{ID: "1"}, {ID: "2"}}, code.Refs)
+
+	survey := agg.papers["doi:10.1145/3212695"]
+	require.NotNil(t, survey)
+	assert.Equal(t, 2, survey.Freq)
+
+	edits := agg.papers["arxiv:1810.13337"]
+	require.NotNil(t, edits)
+	assert.Equal(t, 2, edits.Freq)
+
+	// fuzzy matching disabled
+	agg = newAggregator(1)
+	for _, p := range papers {
+		cp := *p
+		cp.ID = CanonicalID(cp.URL)
+		agg.add(&cp)
+	}
+	assert.Len(t, agg.papers, 5)
+}
+
+func TestCanonicalID(t *testing.T) {
+	var testCases = []struct {
+		url, id string
+	}{
+		{"https://arxiv.org/abs/1911.12863", "arxiv:1911.12863"},
+		{"https://arxiv.org/pdf/1911.12863v2.pdf", "arxiv:1911.12863"},
+		{"http://arxiv.org/abs/cs/0112017v1", "arxiv:cs/0112017"},
+		{"https://doi.org/10.48550/arXiv.1911.12863", "arxiv:1911.12863"},
+		{"https://doi.org/10.1145/3212695", "doi:10.1145/3212695"},
+		{"https://dl.acm.org/doi/abs/10.1145/3212695", "doi:10.1145/3212695"},
+		{"https://dl.acm.org/doi/pdf/10.1145/3212695?download=true", "doi:10.1145/3212695"},
+		{"https://link.springer.com/chapter/10.1007/978-3-030-36808-1_42", "doi:10.1007/978-3-030-36808-1_42"},
+		{"https://link.springer.com/content/pdf/10.1007/s10664-019-09750-6.pdf", "doi:10.1007/s10664-019-09750-6"},
+		{"https://onlinelibrary.wiley.com/doi/full/10.1002/SMR.2220", "doi:10.1002/smr.2220"},
+		{"https://aclanthology.org/2020.acl-main.1.pdf", "acl:2020.acl-main.1"},
+		{"https://www.aclweb.org/anthology/P19-1001/", "acl:p19-1001"},
+		{"https://openreview.net/forum?id=H1gKYo09tX", "openreview:H1gKYo09tX"},
+		{"https://openreview.net/pdf?id=H1gKYo09tX", "openreview:H1gKYo09tX"},
+		{"https://www.semanticscholar.org/paper/Learning-to-Represent-Edits-Yin/5ec2ac7d8dbbe5f3e6c0a0e2e2e5c4c1c8f8d7a1", "s2:5ec2ac7d8dbbe5f3e6c0a0e2e2e5c4c1c8f8d7a1"},
+		{"https://pubmed.ncbi.nlm.nih.gov/31820000/", "pmid:31820000"},
+		{"https://www.ncbi.nlm.nih.gov/pmc/articles/pmc6900000/", "pmcid:PMC6900000"},
+		{"https://ieeexplore.ieee.org/abstract/document/8919471/", ""},
+		{"http://ceur-ws.org/Vol-2510/sattose2019_paper_14.pdf", ""},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.id, CanonicalID(tc.url), tc.url)
+	}
+}
+
+func TestParsePublication(t *testing.T) {
+	var testCases = []struct {
+		line string
+		pub  Publication
+	}{
+		{"A Karmakar - 2019", Publication{
+			Authors: []Author{{"A", "Karmakar"}}, Year: 2019,
+		}},
+		{"M Abdi, H Rocha, S Demeyer", Publication{
+			Authors: []Author{{"M", "Abdi"}, {"H", "Rocha"}, {"S", "Demeyer"}},
+		}},
+		{"S Liu, C Gao, S Chen, LY Nie, Y Liu - arXiv preprint arXiv:1912.02972, 2019", Publication{
+			Authors: []Author{{"S", "Liu"}, {"C", "Gao"}, {"S", "Chen"}, {"LY", "Nie"}, {"Y", "Liu"}},
+			Venue:   "arXiv preprint arXiv:1912.02972", Year: 2019,
+		}},
+		{"PM Nguyen, K Than, M Le Nguyen - … on Knowledge and Systems Engineering (KSE), 2019", Publication{
+			Authors: []Author{{"PM", "Nguyen"}, {"K", "Than"}, {"M", "Le Nguyen"}},
+			Venue:   "on Knowledge and Systems Engineering (KSE)", Year: 2019,
+		}},
+		{"T Nguyen, P Vu, T Nguyen - 2019 IEEE International Conference on Software …", Publication{
+			Authors: []Author{{"T", "Nguyen"}, {"P", "Vu"}, {"T", "Nguyen"}},
+			Venue:   "2019 IEEE International Conference on Software", Year: 2019,
+		}},
+		{"JP Lopez-Garcia, A Smith… - Empirical Software Engineering, 2020 - Springer", Publication{
+			Authors: []Author{{"JP", "Lopez-Garcia"}, {"A", "Smith"}}, EtAl: true,
+			Venue: "Empirical Software Engineering", Year: 2020, Host: "springer",
+		}},
+		{"H Hu, Q Chen - arxiv.org", Publication{
+			Authors: []Author{{"H", "Hu"}, {"Q", "Chen"}}, Host: "arxiv.org",
+		}},
+		{"张三, 李四 - 计算机学报, 2019 - cnki.com.cn", Publication{
+			Authors: []Author{{"", "张三"}, {"", "李四"}},
+			Venue:   "计算机学报", Year: 2019, Host: "cnki.com.cn",
+		}},
+		{"Д Иванов, ПС Петров… - Программирование, 2018 - elibrary.ru", Publication{
+			Authors: []Author{{"Д", "Иванов"}, {"ПС", "Петров"}}, EtAl: true,
+			Venue: "Программирование", Year: 2018, Host: "elibrary.ru",
+		}},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.pub, ParsePublication(tc.line), tc.line)
+	}
+}
+
+func TestFilterAndOrder(t *testing.T) {
+	agg := AggPapers{
+		"a": &Paper{Title: "a", Freq: 3, Year: 2018, Host: "arxiv.org", Authors: []Author{{"H", "Hu"}}},
+		"b": &Paper{Title: "b", Freq: 1, Year: 2020, Host: "export.arxiv.org", Venue: "ICSE"},
+		"c": &Paper{Title: "c", Freq: 2, Authors: []Author{{"", "张三"}}, Refs: []Ref{
+			{ID: "m1", Kind: gmailutils.Search}, {ID: "m2", Kind: gmailutils.Citations},
+		}},
+	}
+
+	assert.Len(t, Filter{}.Apply(agg), 3)
+	assert.Contains(t, Filter{Author: "hu"}.Apply(agg), "a")
+	assert.Contains(t, Filter{Author: "张"}.Apply(agg), "c")
+	assert.Len(t, Filter{Host: "arxiv.org"}.Apply(agg), 2)
+	assert.Len(t, Filter{Venue: "icse"}.Apply(agg), 1)
+	assert.Len(t, Filter{MinYear: 2019}.Apply(agg), 1)
+	assert.Len(t, Filter{MaxYear: 2019}.Apply(agg), 1)
+	assert.Contains(t, Filter{Kind: gmailutils.Citations}.Apply(agg), "c")
+	assert.Empty(t, Filter{Kind: gmailutils.Related}.Apply(agg))
+
+	defer func(o Less) { Order = o }(Order)
+	assert.Equal(t, []string{"a", "c", "b"}, SortedKeys(agg))
+	Order = ByYear
+	assert.Equal(t, []string{"b", "a", "c"}, SortedKeys(agg))
+	Order = ByTitle
+	assert.Equal(t, []string{"a", "b", "c"}, SortedKeys(agg))
+}
+
+func TestDedupSections(t *testing.T) {
+	first := &Section{Label: "a", Stats: &Stats{}, Unread: AggPapers{
+		"doi:10.1145/3212695": {Title: "A Survey of Machine Learning for Big Code and Naturalness", ID: "doi:10.1145/3212695", Freq: 1},
+	}}
+	second := &Section{Label: "b", Stats: &Stats{}, Unread: AggPapers{
+		"a survey of machine learning for big code and naturalness": {Title: "A survey of machine learning for Big Code and Naturalness", Freq: 2},
+		"doi:10.1145/3212695": {Title: "Other title", ID: "doi:10.1145/3212695", Freq: 1},
+		"code2vec":            {Title: "code2vec", Freq: 1},
+	}, Read: AggPapers{
+		"doi:10.1145/3212695": {Title: "A Survey of Machine Learning for Big Code and Naturalness", ID: "doi:10.1145/3212695", Freq: 1},
+	}}
+
+	DedupSections([]*Section{first, second})
+	assert.Len(t, first.Unread, 1)
+	assert.Equal(t, 4, first.Unread["doi:10.1145/3212695"].Freq)
+	assert.Equal(t, []string{"code2vec"}, SortedKeys(second.Unread))
+	assert.Len(t, second.Read, 1, "read papers are not de-duplicated with unread ones")
+}
@@ -0,0 +1,136 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package papers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Author is a single author of a paper, as formatted by Scholar e.g. "LY Nie".
+type Author struct {
+	Initials string `json:",omitempty"`
+	Name     string // family name or, for names \wo initials, a full name
+}
+
+func (a Author) String() string {
+	if a.Initials == "" {
+		return a.Name
+	}
+	return a.Initials + " " + a.Name
+}
+
+// Publication is a parsed "authors - venue, year - host" line, following the paper title.
+type Publication struct {
+	Authors []Author
+	EtAl    bool // the list of authors was truncated by Scholar
+	Venue   string
+	Year    int
+	Host    string
+}
+
+const ellipsis = "…"
+
+var (
+	yearSuffix = regexp.MustCompile(`(?:^|,\s*)((?:19|20)\d\d)$`)
+	yearPrefix = regexp.MustCompile(`^((?:19|20)\d\d)\s`)
+	hostRe     = regexp.MustCompile(`^[\w-]+(\.[\w-]+)+$`)
+)
+
+// ParsePublication parses the publication details, that Scholar puts under the paper title.
+//
+// Parts are separated by a dash surrounded by whitespace, and any of them
+// may be missing or truncated by "…".
+func ParsePublication(line string) Publication {
+	parts := splitOnSpacedDash(strings.TrimSpace(line))
+	var pub Publication
+	pub.Authors, pub.EtAl = parseAuthors(parts[0])
+
+	rest := parts[1:]
+	if n := len(rest); n > 0 && (n > 1 || hostRe.MatchString(rest[n-1])) {
+		pub.Host = strings.ToLower(rest[n-1])
+		rest = rest[:n-1]
+	}
+	if len(rest) == 0 {
+		return pub
+	}
+
+	venue := strings.Join(rest, " - ")
+	if m := yearSuffix.FindStringSubmatchIndex(venue); m != nil {
+		pub.Year, _ = strconv.Atoi(venue[m[2]:m[3]])
+		venue = venue[:m[0]]
+	} else if m := yearPrefix.FindStringSubmatch(venue); m != nil {
+		pub.Year, _ = strconv.Atoi(m[1])
+	}
+	pub.Venue = strings.TrimFunc(venue, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '…' || r == ','
+	})
+	return pub
+}
+
+// splitOnSpacedDash splits on dashes, preceded by a whitespace,
+// so the hyphenated names like "J-P Smith" are kept intact.
+func splitOnSpacedDash(s string) []string {
+	var parts []string
+	start, prevSpace := 0, false
+	for i, r := range s {
+		if prevSpace && unicode.In(r, unicode.Dash) {
+			parts = append(parts, strings.TrimFunc(s[start:i], unicode.IsSpace))
+			start = i + len(string(r))
+		}
+		prevSpace = unicode.IsSpace(r)
+	}
+	return append(parts, strings.TrimFunc(s[start:], unicode.IsSpace))
+}
+
+// parseAuthors splits a comma-separated list of names, reporting if it was truncated.
+func parseAuthors(s string) ([]Author, bool) {
+	etAl := false
+	if trimmed := strings.TrimRight(s, "  "); strings.HasSuffix(trimmed, ellipsis) || strings.HasSuffix(trimmed, "...") {
+		etAl = true
+		s = strings.TrimRight(strings.TrimSuffix(strings.TrimSuffix(trimmed, ellipsis), "..."), " ,")
+	}
+
+	var authors []Author
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '，' || r == '、' }) {
+		if name = strings.TrimFunc(name, unicode.IsSpace); name != "" {
+			authors = append(authors, parseAuthor(name))
+		}
+	}
+	return authors, etAl
+}
+
+// parseAuthor splits Scholar's "H Hu" into initials and a family name.
+// Names \wo leading upper-case initials e.g. in CJK scripts, are kept as a whole.
+func parseAuthor(name string) Author {
+	fields := strings.Fields(name)
+	if len(fields) < 2 || !isInitials(fields[0]) {
+		return Author{Name: strings.Join(fields, " ")}
+	}
+	return Author{Initials: fields[0], Name: strings.Join(fields[1:], " ")}
+}
+
+func isInitials(s string) bool {
+	for _, r := range s {
+		if !unicode.IsUpper(r) && r != '.' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package papers
+
+import "sort"
+
+// Section is a part of the digest, aggregating papers from the emails under one label.
+type Section struct {
+	Label  string
+	Stats  *Stats // of the unread emails
+	Unread AggPapers
+	Read   AggPapers
+}
+
+// DedupSections removes the papers that were already aggregated by one of the previous
+// sections, adding up their frequency and refs there instead.
+// Unread and read papers are de-duplicated separately, same as within a section.
+func DedupSections(sections []*Section) {
+	dedup := func(aggs []AggPapers) {
+		a := newAggregator(TitleSimilarity)
+		for _, agg := range aggs {
+			keys := make([]string, 0, len(agg))
+			for k := range agg {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				n := len(a.keys)
+				a.add(agg[k])
+				if len(a.keys) == n { // merged into a paper of this or a previous section
+					delete(agg, k)
+				}
+			}
+		}
+	}
+
+	var unread, read []AggPapers
+	for _, s := range sections {
+		unread, read = append(unread, s.Unread), append(read, s.Read)
+	}
+	dedup(unread)
+	dedup(read)
+}
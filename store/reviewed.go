@@ -0,0 +1,119 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bzz/scholar-alert-digest/papers"
+	bolt "go.etcd.io/bbolt"
+)
+
+var reviewedBucket = []byte("reviewed")
+
+// idRe matches canonical paper IDs e.g. "doi:10.1145/3212695", see papers.CanonicalID.
+var idRe = regexp.MustCompile(`^[a-z0-9]+:[^\s/]\S*$`)
+
+// reviewKey returns a key to record a paper as reviewed by: a canonical ID,
+// recognized in a URL or given as is, the URL or a normalized title.
+func reviewKey(paper string) string {
+	paper = strings.TrimSpace(paper)
+	switch {
+	case papers.CanonicalID(paper) != "":
+		return papers.CanonicalID(paper)
+	case strings.Contains(paper, "://"), idRe.MatchString(paper):
+		return paper
+	default:
+		return papers.NormalizeTitle(paper)
+	}
+}
+
+// MarkReviewed records the given papers as reviewed by the user at a given time,
+// or clears it if reviewed is false.
+// A paper is referred to by a key of papers.AggPapers, a canonical ID, a URL or a title.
+func (s *Store) MarkReviewed(ps []string, reviewed bool, at time.Time) error {
+	v, err := at.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reviewedBucket)
+		for _, p := range ps {
+			var err error
+			switch key := []byte(reviewKey(p)); {
+			case len(key) == 0:
+				continue
+			case !reviewed:
+				err = b.Delete(key)
+			case b.Get(key) == nil: // keep the first time
+				err = b.Put(key, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reviewed returns the keys of all the given papers that were reviewed.
+func (s *Store) Reviewed(ps papers.AggPapers) (map[string]bool, error) {
+	reviewed := map[string]bool{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reviewedBucket)
+		for key, p := range ps {
+			for _, k := range paperKeys(key, p) {
+				if b.Get([]byte(k)) != nil {
+					reviewed[key] = true
+					break
+				}
+			}
+		}
+		return nil
+	})
+	return reviewed, err
+}
+
+// ReviewedMessages returns sorted IDs of the messages, all the papers of which were reviewed,
+// as referenced by papers.Ref. Messages \w any paper not reviewed yet are not included.
+func (s *Store) ReviewedMessages(ps papers.AggPapers) ([]string, error) {
+	reviewed, err := s.Reviewed(ps)
+	if err != nil {
+		return nil, err
+	}
+
+	done := map[string]bool{} // by message ID
+	for key, p := range ps {
+		for _, ref := range p.Refs {
+			if ok, seen := done[ref.ID]; !seen || ok {
+				done[ref.ID] = reviewed[key]
+			}
+		}
+	}
+
+	var ids []string
+	for id, ok := range done {
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
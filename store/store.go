@@ -0,0 +1,267 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package store persists papers across digest runs in an embedded on-disk database.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bzz/scholar-alert-digest/papers"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	papersBucket   = []byte("papers")
+	aliasesBucket  = []byte("aliases") // other keys of the papers, see paperKeys
+	reportedBucket = []byte("reported")
+)
+
+// Record is a paper, as seen across all the digest runs.
+type Record struct {
+	papers.Paper
+	FirstSeen, LastSeen time.Time
+	Runs                int // number of digests the paper was seen in
+}
+
+// Store is a history of all the papers, keyed the same way as papers.AggPapers,
+// a record of the papers already reported in a digest, and of the ones reviewed by the user.
+//
+// Papers are matched by any of their keys, see paperKeys, so a paper first seen by
+// its title is still the same one once an alert links it to e.g. arXiv.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates a store at the given path.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open paper store %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{papersBucket, aliasesBucket, reportedBucket, reviewedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add records all the given papers as seen at a given time.
+//
+// Refs are accumulated by message ID, so the same email processed by
+// several runs (e.g. still unread) only counts once in the total Freq.
+func (s *Store) Add(ps papers.AggPapers, seen time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, aliases := tx.Bucket(papersBucket), tx.Bucket(aliasesBucket)
+		for key, paper := range ps {
+			keys := paperKeys(key, paper)
+			if k := find(tx, keys); k != "" {
+				key = k
+			}
+			rec, err := get(b, key)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				rec = &Record{Paper: *paper, FirstSeen: seen}
+				rec.Refs = nil
+				rec.Freq = 0
+			}
+			merge(rec, paper, seen)
+
+			if err := put(b, key, rec); err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if k == key || aliases.Get([]byte(k)) != nil {
+					continue
+				}
+				if err := aliases.Put([]byte(k), []byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// paperKeys returns all the keys, a paper could be recorded by: its key in papers.AggPapers,
+// a canonical ID, a URL and a normalized title.
+func paperKeys(key string, p *papers.Paper) []string {
+	var keys []string
+	for _, k := range []string{key, p.ID, p.URL, papers.NormalizeTitle(p.Title)} {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// find returns the key of the recorded paper \w any of the given keys, or "" if there is none.
+func find(tx *bolt.Tx, keys []string) string {
+	b, aliases := tx.Bucket(papersBucket), tx.Bucket(aliasesBucket)
+	for _, k := range keys {
+		if b.Get([]byte(k)) != nil {
+			return k
+		}
+		if key := aliases.Get([]byte(k)); key != nil {
+			return string(key)
+		}
+	}
+	return ""
+}
+
+// merge updates the record \w a paper seen again.
+func merge(rec *Record, paper *papers.Paper, seen time.Time) {
+	if len(paper.Refs) == 0 {
+		rec.Freq += paper.Freq
+	}
+	for _, ref := range paper.Refs {
+		if !hasRef(rec.Refs, ref.ID) {
+			rec.Refs = append(rec.Refs, ref)
+			rec.Freq++
+		}
+	}
+
+	if seen.After(rec.LastSeen) {
+		rec.LastSeen = seen
+	}
+	if seen.Before(rec.FirstSeen) {
+		rec.FirstSeen = seen
+	}
+	rec.Runs++
+}
+
+func hasRef(refs []papers.Ref, id string) bool {
+	for _, r := range refs {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns a record by any of its keys, or nil if there is no such paper.
+func (s *Store) Get(key string) (*Record, error) {
+	var rec *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if k := find(tx, []string{key}); k != "" {
+			key = k
+		}
+		var err error
+		rec, err = get(tx.Bucket(papersBucket), key)
+		return err
+	})
+	return rec, err
+}
+
+// Since returns all the papers last seen after a given time, the most frequent first.
+func (s *Store) Since(t time.Time) ([]*Record, error) {
+	var recs []*Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(papersBucket).ForEach(func(k, v []byte) error {
+			rec := &Record{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("failed to decode paper %q: %v", k, err)
+			}
+			if !rec.LastSeen.Before(t) {
+				recs = append(recs, rec)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Freq > recs[j].Freq })
+	return recs, err
+}
+
+// MarkReported records all the given papers as reported in a digest at a given time.
+func (s *Store) MarkReported(ps papers.AggPapers, reported time.Time) error {
+	v, err := reported.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reportedBucket)
+		for key, paper := range ps {
+			for _, k := range paperKeys(key, paper) {
+				if b.Get([]byte(k)) != nil { // keep the first time
+					continue
+				}
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Unreported returns only the papers that were never reported before, by any of their keys.
+func (s *Store) Unreported(ps papers.AggPapers) (papers.AggPapers, error) {
+	fresh := papers.AggPapers{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reportedBucket)
+	papers:
+		for key, paper := range ps {
+			for _, k := range paperKeys(key, paper) {
+				if b.Get([]byte(k)) != nil {
+					continue papers
+				}
+			}
+			fresh[key] = paper
+		}
+		return nil
+	})
+	return fresh, err
+}
+
+func get(b *bolt.Bucket, key string) (*Record, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, nil
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(v, rec); err != nil {
+		return nil, fmt.Errorf("failed to decode paper %q: %v", key, err)
+	}
+	return rec, nil
+}
+
+func put(b *bolt.Bucket, key string, rec *Record) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), v)
+}
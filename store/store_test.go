@@ -0,0 +1,169 @@
+/**
+ * Copyright 2019 Alexander Bezzubov.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bzz/scholar-alert-digest/papers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := Open(filepath.Join(dir, "papers.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func paper(title string, msgIDs ...string) *papers.Paper {
+	p := &papers.Paper{Title: title, URL: "https://arxiv.org/abs/" + title, Freq: len(msgIDs)}
+	for _, id := range msgIDs {
+		p.Refs = append(p.Refs, papers.Ref{ID: id})
+	}
+	return p
+}
+
+func TestStoreAdd(t *testing.T) {
+	s := newTestStore(t)
+	week1 := time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)
+	week2 := week1.Add(7 * 24 * time.Hour)
+
+	require.NoError(t, s.Add(papers.AggPapers{
+		"a": paper("a", "m1", "m2"),
+		"b": paper("b", "m1"),
+	}, week1))
+	require.NoError(t, s.Add(papers.AggPapers{
+		"a": paper("a", "m2", "m3"), // m2 is still unread
+	}, week2))
+
+	a, err := s.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, a.Freq)
+	assert.Len(t, a.Refs, 3)
+	assert.Equal(t, 2, a.Runs)
+	assert.Equal(t, week1, a.FirstSeen.UTC())
+	assert.Equal(t, week2, a.LastSeen.UTC())
+
+	missing, err := s.Get("c")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestStoreSince(t *testing.T) {
+	s := newTestStore(t)
+	day := 24 * time.Hour
+	now := time.Now()
+
+	require.NoError(t, s.Add(papers.AggPapers{"old": paper("old", "m1")}, now.Add(-100*day)))
+	require.NoError(t, s.Add(papers.AggPapers{"rare": paper("rare", "m2")}, now.Add(-10*day)))
+	require.NoError(t, s.Add(papers.AggPapers{"often": paper("often", "m3", "m4")}, now))
+
+	recs, err := s.Since(now.Add(-90 * day))
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "often", recs[0].Title)
+	assert.Equal(t, "rare", recs[1].Title)
+}
+
+func TestStoreReported(t *testing.T) {
+	s := newTestStore(t)
+	digest1 := papers.AggPapers{"a": paper("a", "m1"), "b": paper("b", "m1")}
+	require.NoError(t, s.MarkReported(digest1, time.Now()))
+
+	digest2 := papers.AggPapers{"b": paper("b", "m2"), "c": paper("c", "m2")}
+	fresh, err := s.Unreported(digest2)
+	require.NoError(t, err)
+	assert.Len(t, fresh, 1)
+	assert.Contains(t, fresh, "c")
+}
+
+func TestStoreKeyChange(t *testing.T) {
+	s := newTestStore(t)
+	week1 := time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)
+	week2 := week1.Add(7 * 24 * time.Hour)
+
+	// first seen \wo an ID, so by the normalized title
+	byTitle := &papers.Paper{Title: "Deep Learning!", URL: "https://scholar.google.com/1", Freq: 1,
+		Refs: []papers.Ref{{ID: "m1"}}}
+	require.NoError(t, s.Add(papers.AggPapers{"deep learning": byTitle}, week1))
+	require.NoError(t, s.MarkReported(papers.AggPapers{"deep learning": byTitle}, week1))
+
+	// then an alert links it to arXiv
+	byID := &papers.Paper{Title: "Deep learning", URL: "https://arxiv.org/abs/1810.13337",
+		ID: "arxiv:1810.13337", Freq: 1, Refs: []papers.Ref{{ID: "m2"}}}
+	agg := papers.AggPapers{"arxiv:1810.13337": byID}
+	require.NoError(t, s.Add(agg, week2))
+
+	fresh, err := s.Unreported(agg)
+	require.NoError(t, err)
+	assert.Empty(t, fresh, "already reported by the title")
+
+	recs, err := s.Since(week1)
+	require.NoError(t, err)
+	require.Len(t, recs, 1, "no duplicate history record")
+	assert.Equal(t, 2, recs[0].Freq)
+	assert.Equal(t, 2, recs[0].Runs)
+	assert.Equal(t, week1, recs[0].FirstSeen.UTC())
+
+	rec, err := s.Get("arxiv:1810.13337")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, 2, rec.Freq)
+
+	// and once more \wo the ID, e.g. from another alert
+	require.NoError(t, s.Add(papers.AggPapers{"deep learning": byTitle}, week2))
+	recs, err = s.Since(week1)
+	require.NoError(t, err)
+	assert.Len(t, recs, 1)
+}
+
+func TestStoreReviewed(t *testing.T) {
+	s := newTestStore(t)
+	a, b, c := paper("1810.13337", "m1", "m2"), paper("1901.00001", "m2"), paper("Not on arXiv", "m3")
+	a.ID, c.URL = papers.CanonicalID(a.URL), "https://example.com/paper.pdf"
+	agg := papers.AggPapers{"arxiv:1810.13337": a, "1901.00001": b, "not on arxiv": c}
+
+	ids, err := s.ReviewedMessages(agg)
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	now := time.Now()
+	require.NoError(t, s.MarkReviewed([]string{"https://arxiv.org/pdf/1810.13337.pdf", "Not on  arXiv!"}, true, now))
+	ids, err = s.ReviewedMessages(agg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1", "m3"}, ids, "m2 has a paper that is not reviewed yet")
+
+	require.NoError(t, s.MarkReviewed([]string{"1901.00001"}, true, now))
+	ids, err = s.ReviewedMessages(agg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m1", "m2", "m3"}, ids)
+
+	require.NoError(t, s.MarkReviewed([]string{"arxiv:1810.13337"}, false, now))
+	ids, err = s.ReviewedMessages(agg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m3"}, ids)
+}
@@ -31,7 +31,7 @@ var (
 </html>
 `))
 
-	MdTemplText = `# Google Scholar Alert Digest
+	MdTemplText = `# Google Scholar Alert Digest{{ if .Label }}: {{ .Label }}{{ end }}
 
 **Date**: {{.Date}}
 **Unread emails**: {{.UnreadEmails}}
@@ -61,7 +61,7 @@ var (
 {{- end}}
 `
 
-	CompactMdTemplText = `# Google Scholar Alert Digest
+	CompactMdTemplText = `# Google Scholar Alert Digest{{ if .Label }}: {{ .Label }}{{ end }}
 
 **Date**: {{.Date}}
 **Unread emails**: {{.UnreadEmails}}
@@ -110,50 +110,77 @@ ul { list-style-type: none; margin: 0; padding: 0 0 0 20px; }
 // Renderer renders papers in one of the supported output formats: Markdown/HTML/JSON/JSONL.
 type Renderer interface {
 	Render(out io.Writer, st *papers.Stats, unread, read papers.AggPapers)
+	// RenderSections renders a digest \w a section per label.
+	RenderSections(out io.Writer, sections []*papers.Section)
+}
+
+// single returns the only section of papers, not under any particular label.
+func single(st *papers.Stats, unread, read papers.AggPapers) []*papers.Section {
+	return []*papers.Section{{Stats: st, Unread: unread, Read: read}}
 }
 
 // JSONRenderer outputs JSON/JSONL formats.
 type JSONRenderer struct {
-	render func(io.Writer, *papers.Stats, papers.AggPapers, papers.AggPapers)
+	render func(io.Writer, []*papers.Section)
 }
 
 // Render papers in JSON/JSONL.
 func (r *JSONRenderer) Render(out io.Writer, st *papers.Stats, unread, read papers.AggPapers) {
-	r.render(out, st, unread, read)
+	r.render(out, single(st, unread, read))
+}
+
+// RenderSections renders papers in JSON/JSONL.
+func (r *JSONRenderer) RenderSections(out io.Writer, sections []*papers.Section) {
+	r.render(out, sections)
 }
 
 // NewJSONRenderer factory for Renderer in JSON format.
+// Several sections are rendered as {"sections": [{"label", "unread", "read"}]},
+// and a single one - as an object \w only "unread" and "read".
 func NewJSONRenderer() Renderer {
 	return &JSONRenderer{
-		render: func(out io.Writer, st *papers.Stats, unread, read papers.AggPapers) {
+		render: func(out io.Writer, sections []*papers.Section) {
 			log.Printf("formatting gmail messages in JSON")
 
-			sr := []*papers.Paper{}
-			for _, title := range papers.SortedKeys(read) {
-				sr = append(sr, read[title])
+			var all []map[string]interface{}
+			for _, s := range sections {
+				all = append(all, jsonSection(s))
 			}
 
-			su := []*papers.Paper{}
-			for _, title := range papers.SortedKeys(unread) {
-				su = append(su, unread[title])
+			encoder := json.NewEncoder(out)
+			if len(all) == 1 {
+				delete(all[0], "label")
+				encoder.Encode(all[0])
+				return
 			}
+			encoder.Encode(map[string]interface{}{"sections": all})
+		},
+	}
+}
 
-			all := map[string]interface{}{
-				"read": map[string]interface{}{
-					"papers": sr,
-				},
-				"unread": map[string]interface{}{
-					"papers": su,
-					"stats": map[string]interface{}{
-						"time":     time.Now().Format(time.RFC3339),
-						"messages": st.Msgs,
-						"papers":   st.Titles,
-					},
-				},
-			}
+func jsonSection(s *papers.Section) map[string]interface{} {
+	sr := []*papers.Paper{}
+	for _, title := range papers.SortedKeys(s.Read) {
+		sr = append(sr, s.Read[title])
+	}
 
-			encoder := json.NewEncoder(out)
-			encoder.Encode(all)
+	su := []*papers.Paper{}
+	for _, title := range papers.SortedKeys(s.Unread) {
+		su = append(su, s.Unread[title])
+	}
+
+	return map[string]interface{}{
+		"label": s.Label,
+		"read": map[string]interface{}{
+			"papers": sr,
+		},
+		"unread": map[string]interface{}{
+			"papers": su,
+			"stats": map[string]interface{}{
+				"time":     time.Now().Format(time.RFC3339),
+				"messages": s.Stats.Msgs,
+				"papers":   s.Stats.Titles,
+			},
 		},
 	}
 }
@@ -161,14 +188,18 @@ func NewJSONRenderer() Renderer {
 // NewJSONLRenderer factory for Renderer in JSONL format.
 func NewJSONLRenderer() Renderer {
 	return &JSONRenderer{
-		render: func(out io.Writer, st *papers.Stats, unread, read papers.AggPapers) {
+		render: func(out io.Writer, sections []*papers.Section) {
 			log.Print("formatting gmail messages in JSONL")
 			encoder := json.NewEncoder(out)
-			for _, title := range papers.SortedKeys(unread) {
-				encoder.Encode(unread[title])
+			for _, s := range sections {
+				for _, title := range papers.SortedKeys(s.Unread) {
+					encoder.Encode(s.Unread[title])
+				}
 			}
-			for _, title := range papers.SortedKeys(read) {
-				encoder.Encode(read[title])
+			for _, s := range sections {
+				for _, title := range papers.SortedKeys(s.Read) {
+					encoder.Encode(s.Read[title])
+				}
 			}
 		},
 	}
@@ -206,24 +237,33 @@ func NewMarkdownRenderer(templateText, oldTemplateText string) Renderer {
 }
 
 func (r *MarkdownRenderer) Render(out io.Writer, st *papers.Stats, unread, read papers.AggPapers) {
-	r.newMdReport(out, st, unread)
-	if read != nil {
-		r.oldMdReport(out, read)
+	r.RenderSections(out, single(st, unread, read))
+}
+
+// RenderSections renders a report per section, one after another.
+func (r *MarkdownRenderer) RenderSections(out io.Writer, sections []*papers.Section) {
+	for _, s := range sections {
+		r.newMdReport(out, s.Label, s.Stats, s.Unread)
+		if s.Read != nil {
+			r.oldMdReport(out, s.Read)
+		}
 	}
 }
 
 // newMdReport renderes tmplText \w email msg stats (for new, unread papers).
-func (r *MarkdownRenderer) newMdReport(out io.Writer, st *papers.Stats, agrPapers papers.AggPapers) {
+func (r *MarkdownRenderer) newMdReport(out io.Writer, label string, st *papers.Stats, agrPapers papers.AggPapers) {
 	layout := template.Must(r.layout.Clone())
 	tmpl := template.Must(layout.Parse(r.template))
 	tmpl = template.Must(tmpl.Parse(refsMdTemplateText))
 	err := tmpl.Execute(out, struct {
+		Label        string
 		Date         string
 		UnreadEmails int
 		TotalPapers  int
 		UniqPapers   int
 		Papers       papers.AggPapers
 	}{
+		label,
 		time.Now().Format(time.RFC3339),
 		st.Msgs,
 		st.Titles,
@@ -257,8 +297,13 @@ func NewHTMLRenderer(templateText, style string) Renderer {
 }
 
 func (r *HTMLRenderer) Render(out io.Writer, st *papers.Stats, unread, read papers.AggPapers) {
+	r.RenderSections(out, single(st, unread, read))
+}
+
+// RenderSections renders all the sections in Markdown, as a single HTML page.
+func (r *HTMLRenderer) RenderSections(out io.Writer, sections []*papers.Section) {
 	var mdBuf bytes.Buffer
-	r.Renderer.Render(&mdBuf, st, unread, read)
+	r.Renderer.RenderSections(&mdBuf, sections)
 
 	var htmlBuf bytes.Buffer
 	md := markdown.New(markdown.XHTMLOutput(true), markdown.HTML(true))